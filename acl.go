@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseCIDRs parses a list of CIDRs, plain IP addresses are treated as
+// single-address networks.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, entry := range list {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("malformed address: %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAllowed reports whether queries from addr should be served. All
+// clients are allowed if allowed_clients is empty.
+func (s *Server) clientAllowed(addr net.Addr) bool {
+	if len(s.allowedClients) == 0 {
+		return true
+	}
+	ip := remoteIP(addr)
+	if ip == nil {
+		return false
+	}
+	return containsIP(s.allowedClients, ip)
+}
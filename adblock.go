@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"unicode"
+)
+
+// Separators of cosmetic (element hiding) filters, e.g. example.org##.ad.
+var adblockCosmetic = []string{"##", "#@#", "#?#", "#$#"}
+
+// isAdblockRule reports whether line uses the AdBlock Plus filter syntax and
+// should be handled by parseAdblock. Lines with cosmetic filters must not be
+// handled as hosts entries since removing the "#..." comment leaves the
+// domain to which the filter applies, see isCosmeticFilter.
+func isAdblockRule(line string) bool {
+	if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") || strings.HasPrefix(line, "!") {
+		return true
+	}
+	// [Adblock Plus 2.0] header.
+	if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+		return true
+	}
+	return isCosmeticFilter(line)
+}
+
+// isCosmeticFilter reports whether line is a cosmetic filter, i.e. a list of
+// domains directly followed by one of adblockCosmetic separators, such as
+// "example.org,~www.example.org##.ad". Hosts entries with a trailing "## ..."
+// comment are not, since they have whitespace or an address before it.
+func isCosmeticFilter(line string) bool {
+	for _, sep := range adblockCosmetic {
+		indx := strings.Index(line, sep)
+		if indx <= 0 {
+			continue
+		}
+		return isCosmeticDomainList(line[:indx])
+	}
+	return false
+}
+
+// isCosmeticDomainList reports whether s is a comma-separated list of domains
+// that cosmetic filters apply to, optionally excluded with "~".
+func isCosmeticDomainList(s string) bool {
+	for _, domain := range strings.Split(s, ",") {
+		domain = strings.TrimPrefix(domain, "~")
+		if domain == "" || net.ParseIP(domain) != nil {
+			return false
+		}
+		for _, r := range domain {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			case r == '.', r == '-', r == '_', r == '*', r > unicode.MaxASCII:
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseAdblock adds the domain blocked by the ||example.org^ rule to the set,
+// blocking it along with all subdomains as AdBlock Plus does. Comments are
+// ignored. false is returned for rules that cannot be applied to DNS: cosmetic
+// filters, exceptions (@@) and rules with URL paths, wildcards or options other
+// than $important.
+func parseAdblock(line string, set *domainSet) bool {
+	if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return true
+	}
+	if !strings.HasPrefix(line, "||") {
+		return false
+	}
+
+	rule := line[2:]
+	if indx := strings.IndexByte(rule, '$'); indx != -1 {
+		for _, opt := range strings.Split(rule[indx+1:], ",") {
+			if opt != "important" {
+				return false
+			}
+		}
+		rule = rule[:indx]
+	}
+	rule = strings.TrimSuffix(rule, "|")
+	if !strings.HasSuffix(rule, "^") {
+		return false
+	}
+	domain := strings.TrimSuffix(rule, "^")
+	if domain == "" || strings.ContainsAny(domain, "*/^|:") {
+		return false
+	}
+
+	domain = set.normalizeEntry(domain)
+	set.add(domain)
+	set.addWildcard(domain)
+	return true
+}
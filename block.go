@@ -0,0 +1,543 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	blockNXDOMAIN = "nxdomain"
+	blockNODATA   = "nodata"
+	blockZeroIP   = "zeroip"
+	blockRefused  = "refused"
+)
+
+// SVCB and HTTPS record types (RFC 9460), not known to the dns package
+// version in use.
+const (
+	typeSVCB  uint16 = 64
+	typeHTTPS uint16 = 65
+)
+
+// Values of the mode option.
+const (
+	// Block blacklisted names, forward the rest.
+	modeBlocklist = "blocklist"
+	// Forward whitelisted names, block the rest.
+	modeAllowlist = "allowlist"
+)
+
+func checkMode(mode string) error {
+	switch mode {
+	case modeBlocklist, modeAllowlist:
+		return nil
+	default:
+		return fmt.Errorf("unknown mode: %s", mode)
+	}
+}
+
+// Owner names of synthesized SOA records, see block_soa.owner.
+const (
+	soaOwnerQname  = "qname"
+	soaOwnerParent = "parent"
+)
+
+func checkSOAOwner(owner string) error {
+	switch owner {
+	case soaOwnerQname, soaOwnerParent:
+		return nil
+	default:
+		return fmt.Errorf("unknown block_soa.owner: %s", owner)
+	}
+}
+
+// parseSinkhole parses the sinkhole address for blocked A (ipv6 is false) or
+// AAAA queries, nil is returned for an empty string.
+func parseSinkhole(addr string, ipv6 bool) (net.IP, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("malformed address: %s", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if ipv6 {
+			return nil, fmt.Errorf("not an IPv6 address: %s", addr)
+		}
+		return ip4, nil
+	}
+	if !ipv6 {
+		return nil, fmt.Errorf("not an IPv4 address: %s", addr)
+	}
+	return ip, nil
+}
+
+func checkBlockMode(mode string) error {
+	switch mode {
+	case blockNXDOMAIN, blockNODATA, blockZeroIP, blockRefused:
+		return nil
+	default:
+		return fmt.Errorf("unknown block_mode: %s", mode)
+	}
+}
+
+// parentDomain returns the name with the leftmost label removed or an empty
+// string for single-label names.
+func parentDomain(name string) string {
+	indx := strings.IndexByte(name, '.')
+	if indx == -1 {
+		return ""
+	}
+	return name[indx+1:]
+}
+
+// isBlocked reports whether the normalized name is blacklisted in view v (nil
+// for the global lists).
+//
+// A name is blacklisted if it is listed, if any of its parent domains is
+// listed (with subdomain blocking enabled), if it is a subdomain of a
+// wildcard entry or if it matches a pattern. The whitelist always wins: names
+// that are whitelisted or match a whitelist wildcard or pattern are never
+// blocked, regardless of how they matched the blacklist.
+//
+// In allowlist mode, blacklists are not used and all names are blocked
+// unless they or their parent domains are whitelisted.
+//
+// Overrides set using the control socket take precedence over everything
+// except for block_cname, which is never blocked so that clients following
+// the CNAME do not loop. Lists from disabled categories are not consulted.
+func (s *Server) isBlocked(v *view, name string) bool {
+	if p := s.policyFor(v); p.cname != "" && name == p.cname {
+		return false
+	}
+
+	s.listsLock.RLock()
+	defer s.listsLock.RUnlock()
+
+	if blocked, ok := s.overrides[name]; ok {
+		return blocked
+	}
+
+	l := s.listsFor(v)
+	if l == nil {
+		// Not loaded yet, see startupReply.
+		return false
+	}
+	if s.allowlistMode {
+		_, white := l.white.match(name, true)
+		return !white
+	}
+	return l.blocked(name, s.blockSubdomains, s.disabledCategories)
+}
+
+// blockedFor is isBlocked for a query from client, consulting the
+// external_policy program first if it is configured. If the program fails,
+// too many are running or it answers default, the lists decide. Overrides
+// and block_cname are handled by isBlocked without running the program.
+func (s *Server) blockedFor(v *view, client net.IP, name string) bool {
+	if s.externalPolicy == nil || client == nil || s.hasOverride(name) {
+		return s.isBlocked(v, name)
+	}
+	if p := s.policyFor(v); p.cname != "" && name == p.cname {
+		return false
+	}
+
+	verdict, err := s.externalPolicy.decide(client, name)
+	if err != nil {
+		// Not logged for each query under load, the counter shows it.
+		if !errors.Is(err, errPolicyBusy) {
+			log.Println("External policy failed, using lists:", err)
+		}
+		atomic.AddUint32(&s.externalPolicyErrCnt, 1)
+		return s.isBlocked(v, name)
+	}
+	switch verdict {
+	case policyAllow:
+		return false
+	case policyBlock:
+		return true
+	default:
+		return s.isBlocked(v, name)
+	}
+}
+
+// isRPZNODATA reports whether the normalized name is blocked by an RPZ
+// NODATA rule in view v and should get a NODATA reply instead of the one
+// configured by block_mode.
+func (s *Server) isRPZNODATA(v *view, name string) bool {
+	s.listsLock.RLock()
+	defer s.listsLock.RUnlock()
+	l := s.listsFor(v)
+	if l == nil || l.nodata == nil {
+		return false
+	}
+	_, ok := l.nodata.match(name, s.blockSubdomains)
+	return ok
+}
+
+func (s *Server) hasOverride(name string) bool {
+	s.listsLock.RLock()
+	defer s.listsLock.RUnlock()
+	_, ok := s.overrides[name]
+	return ok
+}
+
+func (l *domainLists) blocked(name string, subdomains bool, disabled map[string]bool) bool {
+	if _, _, ok := l.matchBlack(name, subdomains, disabled); !ok {
+		return false
+	}
+	_, white := l.white.match(name, false)
+	return !white
+}
+
+// blockSOARR returns the SOA record for the authority section of negative
+// responses to q. Its owner is the query name or, with block_soa.owner set to
+// parent, the parent domain, so the response does not claim that the absent
+// name is a zone apex.
+func (s *Server) blockSOARR(q dns.Question) dns.RR {
+	owner := q.Name
+	if s.blockSOA.Owner == soaOwnerParent {
+		if off, end := dns.NextLabel(q.Name, 0); end {
+			owner = "."
+		} else {
+			owner = q.Name[off:]
+		}
+	}
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   owner,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    s.blockSOA.TTL,
+		},
+		Ns:      s.blockSOA.Ns,
+		Mbox:    s.blockSOA.Mbox,
+		Serial:  1,
+		Refresh: 900,
+		Retry:   900,
+		Expire:  1800,
+		Minttl:  s.blockSOA.Minttl,
+	}
+}
+
+// nodataReply synthesizes an empty NOERROR response with SOA in the
+// authority section.
+func (s *Server) nodataReply(m *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	reply.RecursionAvailable = s.recursion
+	reply.Ns = []dns.RR{s.blockSOARR(m.Question[0])}
+	return reply
+}
+
+func parseQtypes(names []string) (map[uint16]struct{}, error) {
+	qtypes := make(map[uint16]struct{}, len(names))
+	for _, name := range names {
+		qtype, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown record type: %s", name)
+		}
+		qtypes[qtype] = struct{}{}
+	}
+	return qtypes, nil
+}
+
+const (
+	anyHINFO   = "hinfo"
+	anyRefused = "refused"
+	anyForward = "forward"
+)
+
+func checkAnyMode(mode string) error {
+	switch mode {
+	case anyHINFO, anyRefused, anyForward:
+		return nil
+	default:
+		return fmt.Errorf("unknown any_query_mode: %s", mode)
+	}
+}
+
+// anyReply synthesizes the response for a query of type ANY to avoid
+// amplification. It returns nil if the query should be forwarded.
+func (s *Server) anyReply(m *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	reply.RecursionAvailable = s.recursion
+
+	switch s.anyMode {
+	case anyForward:
+		return nil
+	case anyRefused:
+		reply.Rcode = dns.RcodeRefused
+	default:
+		// RFC 8482, Section 4.2.
+		reply.Answer = []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{
+				Name:   m.Question[0].Name,
+				Rrtype: dns.TypeHINFO,
+				Class:  dns.ClassINET,
+				Ttl:    s.blockTTL,
+			},
+			Cpu: "RFC8482",
+		}}
+	}
+	return reply
+}
+
+// blockPolicy defines how blocked queries are answered, globally or for
+// clients of a view.
+type blockPolicy struct {
+	mode string
+	// Addresses in answers to blocked A/AAAA queries, nil if not set.
+	sinkholeV4 net.IP
+	sinkholeV6 net.IP
+	// Normalized target of CNAME answers to blocked A/AAAA queries, empty if
+	// not set. It is never blocked itself.
+	cname string
+}
+
+// answersAddresses reports whether A and AAAA queries for blocked names get
+// answers instead of a negative response.
+func (p *blockPolicy) answersAddresses() bool {
+	return p.cname != "" || p.sinkholeV4 != nil || p.sinkholeV6 != nil || p.mode == blockZeroIP
+}
+
+// policyFor returns the block policy for queries from view v (nil for the
+// global policy).
+func (s *Server) policyFor(v *view) *blockPolicy {
+	if v != nil && v.block != nil {
+		return v.block
+	}
+	return &s.policy
+}
+
+// blockReply synthesizes the response for a blocked query according to the
+// block mode of p.
+//
+// If p has a CNAME target, A and AAAA queries are answered with a CNAME to it
+// (followed by its local records, if any). Otherwise, if sinkhole addresses
+// are configured, A and AAAA queries are answered with them regardless of the
+// block mode, with NODATA if there is no address of the requested family.
+//
+// SVCB and HTTPS queries get NODATA whenever A and AAAA queries are answered
+// with addresses, so clients do not get a negative response for the name from
+// one and an address from the other.
+func (s *Server) blockReply(m *dns.Msg, p *blockPolicy) *dns.Msg {
+	q := m.Question[0]
+
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	reply.RecursionAvailable = s.recursion
+
+	if (q.Qtype == typeSVCB || q.Qtype == typeHTTPS) && p.answersAddresses() {
+		reply.Ns = []dns.RR{s.blockSOARR(q)}
+		return reply
+	}
+
+	if p.cname != "" && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		reply.Answer = []dns.RR{&dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    s.blockTTL,
+			},
+			Target: dns.Fqdn(p.cname),
+		}}
+		if s.local != nil {
+			rrs, _ := s.local.lookup(p.cname, q.Qtype)
+			reply.Answer = append(reply.Answer, rrs...)
+		}
+		return reply
+	}
+
+	if (p.sinkholeV4 != nil || p.sinkholeV6 != nil) && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		hdr := dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: q.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    s.blockTTL,
+		}
+		switch {
+		case q.Qtype == dns.TypeA && p.sinkholeV4 != nil:
+			reply.Answer = []dns.RR{&dns.A{Hdr: hdr, A: p.sinkholeV4}}
+		case q.Qtype == dns.TypeAAAA && p.sinkholeV6 != nil:
+			reply.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: p.sinkholeV6}}
+		default:
+			reply.Ns = []dns.RR{s.blockSOARR(q)}
+		}
+		return reply
+	}
+
+	switch p.mode {
+	case blockRefused:
+		reply.Rcode = dns.RcodeRefused
+	case blockZeroIP:
+		hdr := dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: q.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    s.blockTTL,
+		}
+		switch q.Qtype {
+		case dns.TypeA:
+			reply.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+		case dns.TypeAAAA:
+			reply.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+		default:
+			reply.Ns = []dns.RR{s.blockSOARR(q)}
+		}
+	case blockNODATA:
+		reply.Ns = []dns.RR{s.blockSOARR(q)}
+	default:
+		reply.Rcode = dns.RcodeNameError
+		reply.Ns = []dns.RR{s.blockSOARR(q)}
+	}
+
+	return reply
+}
+
+// sinkholeNames returns normalized reverse names of addresses used in
+// synthesized answers for the block policies: the unspecified addresses of
+// zeroip mode and sinkhole addresses.
+func sinkholeNames(policies ...*blockPolicy) map[string]struct{} {
+	var ips []net.IP
+	for _, p := range policies {
+		if p.mode == blockZeroIP {
+			ips = append(ips, net.IPv4zero, net.IPv6zero)
+		}
+		if p.sinkholeV4 != nil {
+			ips = append(ips, p.sinkholeV4)
+		}
+		if p.sinkholeV6 != nil {
+			ips = append(ips, p.sinkholeV6)
+		}
+	}
+
+	names := make(map[string]struct{})
+	for _, ip := range ips {
+		arpa, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			panic(err)
+		}
+		names[normalize(arpa)] = struct{}{}
+	}
+	return names
+}
+
+// privateReverseZones are reverse zones of loopback, RFC 1918, link-local and
+// unique local addresses, names in them are meaningless outside the local
+// network.
+var privateReverseZones = map[string]struct{}{
+	"127.in-addr.arpa":     {},
+	"10.in-addr.arpa":      {},
+	"168.192.in-addr.arpa": {},
+	"254.169.in-addr.arpa": {},
+	"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa": {},
+	"c.f.ip6.arpa":   {},
+	"d.f.ip6.arpa":   {},
+	"8.e.f.ip6.arpa": {},
+	"9.e.f.ip6.arpa": {},
+	"a.e.f.ip6.arpa": {},
+	"b.e.f.ip6.arpa": {},
+}
+
+func init() {
+	for i := 16; i <= 31; i++ {
+		privateReverseZones[strconv.Itoa(i)+".172.in-addr.arpa"] = struct{}{}
+	}
+}
+
+// isPrivateReverse reports whether the normalized name is in one of
+// privateReverseZones.
+func isPrivateReverse(name string) bool {
+	for ; name != ""; name = parentDomain(name) {
+		if _, ok := privateReverseZones[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ptrReply answers PTR queries for addresses from synthesized answers and,
+// with block_private_ptr, for private addresses authoritatively with
+// NXDOMAIN instead of forwarding them. nil is returned for other queries.
+func (s *Server) ptrReply(m *dns.Msg, name string) *dns.Msg {
+	if m.Question[0].Qtype != dns.TypePTR {
+		return nil
+	}
+	_, sinkhole := s.sinkholePTR[name]
+	if !sinkhole && !(s.blockPrivatePTR && isPrivateReverse(name)) {
+		return nil
+	}
+	return s.nxdomainReply(m)
+}
+
+// nxdomainReply returns an authoritative NXDOMAIN reply for names rhole
+// knows not to exist.
+func (s *Server) nxdomainReply(m *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetRcode(m, dns.RcodeNameError)
+	reply.Authoritative = true
+	reply.RecursionAvailable = s.recursion
+	reply.Ns = []dns.RR{s.blockSOARR(m.Question[0])}
+	return reply
+}
+
+// block counts the query for a blacklisted name and writes the block reply
+// according to the policy of view v, name is what matched the blacklist. In
+// monitor mode the reply is not written and false is returned, the query
+// should be processed as usual then.
+func (s *Server) block(v *view, w dns.ResponseWriter, m *dns.Msg, ql *queryLogEntry, name string) bool {
+	atomic.AddUint32(&s.blockedCnt, 1)
+	if s.blockHits != nil {
+		s.blockHits.hit(name)
+	}
+	if s.monitorMode {
+		log.Printf("Would block %s", name)
+		if ql != nil {
+			ql.WouldBlock = true
+		}
+		return false
+	}
+
+	if ql != nil {
+		ql.Blocked = true
+	}
+	p := s.policyFor(v)
+	if s.isRPZNODATA(v, name) {
+		p = &blockPolicy{mode: blockNODATA}
+	}
+	if err := w.WriteMsg(s.blockReply(m, p)); err != nil {
+		log.Printf("WriteMsg: %v", err)
+	}
+	return true
+}
+
+// cloakedTarget returns the first blacklisted CNAME target in the answer
+// section of resp or an empty string if there is none or CNAME uncloaking is
+// disabled. In allowlist mode, targets of allowed names are not checked, they
+// are often CDN names nobody would whitelist.
+func (s *Server) cloakedTarget(v *view, resp *dns.Msg) string {
+	if !s.cnameUncloaking || s.allowlistMode {
+		return ""
+	}
+	for _, rr := range resp.Answer {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		if target := normalize(cname.Target); s.isBlocked(v, target) {
+			return target
+		}
+	}
+	return ""
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// cnameStub answers A queries for cloaked.example.org with a CNAME chain
+// ending at a blacklisted tracker, other names get an A record.
+func cnameStub(w dns.ResponseWriter, m *dns.Msg) {
+	q := m.Question[0]
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	cname := func(name, target string) dns.RR {
+		return &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+			Target: target,
+		}
+	}
+	switch q.Name {
+	case "cloaked.example.org.":
+		reply.Answer = []dns.RR{
+			cname(q.Name, "edge.cdn.example.net."),
+			cname("edge.cdn.example.net.", "t.tracker.example.com."),
+			testAnswer(dns.Question{Name: "t.tracker.example.com."}, "192.0.2.1"),
+		}
+	case "clean.example.org.":
+		reply.Answer = []dns.RR{
+			cname(q.Name, "edge.cdn.example.net."),
+			testAnswer(dns.Question{Name: "edge.cdn.example.net."}, "192.0.2.1"),
+		}
+	default:
+		reply.Answer = []dns.RR{testAnswer(q, "192.0.2.1")}
+	}
+	w.WriteMsg(reply)
+}
+
+func TestCNAMEUncloaking(t *testing.T) {
+	addr := startStub(t, cnameStub)
+	files := map[string]string{"bl.txt": "tracker.example.com\n"}
+
+	cases := []struct {
+		uncloaking bool
+		name       string
+		rcode      int
+	}{
+		{true, "cloaked.example.org.", dns.RcodeNameError},
+		{true, "clean.example.org.", dns.RcodeSuccess},
+		{true, "plain.example.org.", dns.RcodeSuccess},
+		{false, "cloaked.example.org.", dns.RcodeSuccess},
+	}
+	for _, c := range cases {
+		config := `downstreams = ["` + addr + `"]
+blacklists = ["$DIR/bl.txt"]
+block_subdomains = true
+cache_size = 10`
+		if c.uncloaking {
+			config += "\ncname_uncloaking = true"
+		}
+		s := newTestServer(t, config, files)
+
+		// The second query checks the cached response.
+		for i := 0; i < 2; i++ {
+			m := new(dns.Msg)
+			m.SetQuestion(c.name, dns.TypeA)
+			reply := serve(s, "udp", m)
+			if reply == nil {
+				t.Fatalf("%s: no reply", c.name)
+			}
+			if reply.Rcode != c.rcode {
+				t.Errorf("%s (uncloaking %v): query %d: rcode %s, expected %s", c.name, c.uncloaking, i,
+					dns.RcodeToString[reply.Rcode], dns.RcodeToString[c.rcode])
+			}
+		}
+	}
+}
+
+func TestIsBlockedWhitelist(t *testing.T) {
+	// The downstream is never contacted.
+	s := newTestServer(t, `downstreams = ["192.0.2.53"]
+blacklists = ["$DIR/bl.txt"]
+whitelists = ["$DIR/wl.txt"]
+block_subdomains = true
+regex_lists = true`, map[string]string{
+		"bl.txt": "example.com\nexact.example.org\n/^ads[0-9]+\\./\n",
+		"wl.txt": "ok.example.com\nexact.example.org\nads1.example.net\n",
+	})
+
+	cases := []struct {
+		name    string
+		blocked bool
+	}{
+		{"example.com", true},
+		{"sub.example.com", true},
+		// Whitelisted subdomain of a blocked parent.
+		{"ok.example.com", false},
+		// Whitelist entries without "*." are exact.
+		{"deeper.ok.example.com", true},
+		{"other.example.com", true},
+		// Exact match.
+		{"exact.example.org", false},
+		// Pattern match.
+		{"ads1.example.net", false},
+		{"ads2.example.net", true},
+		{"unlisted.example.net", false},
+	}
+	for _, c := range cases {
+		if blocked := s.isBlocked(nil, c.name); blocked != c.blocked {
+			t.Errorf("%s: blocked is %v, expected %v", c.name, blocked, c.blocked)
+		}
+	}
+}
+
+func TestIsBlockedWildcardWhitelist(t *testing.T) {
+	files := map[string]string{
+		"bl.txt": "syndication.example.com\nads.safeframe.syndication.example.com\n",
+		"wl.txt": "*.safeframe.syndication.example.com\n",
+	}
+	cases := []struct {
+		name    string
+		blocked bool
+	}{
+		{"syndication.example.com", true},
+		{"tracker.syndication.example.com", true},
+		// The wildcard does not cover the name itself.
+		{"safeframe.syndication.example.com", true},
+		{"a.safeframe.syndication.example.com", false},
+		{"b.a.safeframe.syndication.example.com", false},
+		// Whitelisted even though it is listed itself.
+		{"ads.safeframe.syndication.example.com", false},
+		{"notsafeframe.syndication.example.com", true},
+	}
+	addr := startStub(t, answeringStub)
+	s := newTestServer(t, `downstreams = ["`+addr+`"]
+blacklists = ["$DIR/bl.txt"]
+whitelists = ["$DIR/wl.txt"]
+block_subdomains = true`, files)
+	for _, c := range cases {
+		if blocked := s.isBlocked(nil, c.name); blocked != c.blocked {
+			t.Errorf("%s: blocked is %v, expected %v", c.name, blocked, c.blocked)
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(c.name), dns.TypeA)
+		reply := serve(s, "udp", m)
+		if reply == nil {
+			t.Fatalf("%s: no reply", c.name)
+		}
+		if blocked := reply.Rcode == dns.RcodeNameError; blocked != c.blocked {
+			t.Errorf("%s: rcode %s, expected blocked %v", c.name, dns.RcodeToString[reply.Rcode], c.blocked)
+		}
+	}
+}
+
+func TestBlockSOAOwner(t *testing.T) {
+	cases := []struct {
+		owner    string
+		name     string
+		expected string
+	}{
+		{soaOwnerQname, "a.example.com.", "a.example.com."},
+		{soaOwnerQname, "com.", "com."},
+		{soaOwnerParent, "a.example.com.", "example.com."},
+		{soaOwnerParent, "example.com.", "com."},
+		{soaOwnerParent, "com.", "."},
+		{soaOwnerParent, ".", "."},
+	}
+	for _, c := range cases {
+		s := newTestServer(t, `downstreams = ["192.0.2.53"]
+blacklists = ["$DIR/bl.txt"]
+block_subdomains = true
+
+[block_soa]
+owner = "`+c.owner+`"`, map[string]string{"bl.txt": "com\n"})
+
+		soa := s.blockSOARR(dns.Question{Name: c.name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		if owner := soa.Header().Name; owner != c.expected {
+			t.Errorf("%s %s: owner is %s, expected %s", c.owner, c.name, owner, c.expected)
+		}
+		if c.name == "." {
+			continue
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion(c.name, dns.TypeA)
+		reply := serve(s, "udp", m)
+		if reply == nil {
+			t.Fatalf("%s %s: no reply", c.owner, c.name)
+		}
+		if len(reply.Ns) != 1 || reply.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("%s %s: authority section is %v, expected SOA", c.owner, c.name, reply.Ns)
+		} else if owner := reply.Ns[0].Header().Name; owner != c.expected {
+			t.Errorf("%s %s: reply SOA owner is %s, expected %s", c.owner, c.name, owner, c.expected)
+		}
+	}
+}
+
+func TestBlockReplySVCB(t *testing.T) {
+	cases := []struct {
+		config string
+		rcode  int
+	}{
+		{``, dns.RcodeNameError},
+		{`block_mode = "nxdomain"`, dns.RcodeNameError},
+		{`block_mode = "refused"`, dns.RcodeRefused},
+		{`block_mode = "zeroip"`, dns.RcodeSuccess},
+		{`sinkhole_ipv4 = "192.0.2.10"`, dns.RcodeSuccess},
+		{`block_cname = "blocked.example.net"`, dns.RcodeSuccess},
+	}
+	for _, c := range cases {
+		s := newTestServer(t, `downstreams = ["192.0.2.53"]
+blacklists = ["$DIR/bl.txt"]
+`+c.config, map[string]string{"bl.txt": "blocked.example.org\n"})
+
+		for _, qtype := range []uint16{typeSVCB, typeHTTPS} {
+			m := new(dns.Msg)
+			m.SetQuestion("blocked.example.org.", qtype)
+			reply := serve(s, "udp", m)
+			if reply == nil {
+				t.Fatalf("%q, type %d: no reply", c.config, qtype)
+			}
+			if reply.Rcode != c.rcode {
+				t.Errorf("%q, type %d: rcode %s, expected %s", c.config, qtype,
+					dns.RcodeToString[reply.Rcode], dns.RcodeToString[c.rcode])
+			}
+			if len(reply.Answer) != 0 {
+				t.Errorf("%q, type %d: %d answers, expected none", c.config, qtype, len(reply.Answer))
+			}
+			if c.rcode == dns.RcodeSuccess && (len(reply.Ns) != 1 || reply.Ns[0].Header().Rrtype != dns.TypeSOA) {
+				t.Errorf("%q, type %d: authority section is %v, expected SOA", c.config, qtype, reply.Ns)
+			}
+		}
+	}
+}
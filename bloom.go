@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	bloomBitsPerEntry = 10
+	bloomHashes       = 7
+)
+
+// compactSet is a memory-efficient replacement for a map of domains.
+//
+// Domains are stored as sorted 64-bit hashes, with a bloom filter in front
+// to avoid binary search for most names that are not in the set. Unlike the
+// bloom filter alone, false positives are only possible in case of 64-bit
+// hash collisions.
+type compactSet struct {
+	bloom  []uint64
+	hashes []uint64
+}
+
+func hashName(name string) uint64 {
+	// FNV-1a
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(name); i++ {
+		h ^= uint64(name[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// bloomIndexes derives bloom filter hash functions from h using double
+// hashing after remixing it with the SplitMix64 finalizer.
+func bloomIndexes(h uint64, bits uint64, f func(uint64) bool) bool {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+
+	h1, h2 := h&0xffffffff, h>>32
+	for i := uint64(0); i < bloomHashes; i++ {
+		if !f((h1 + i*h2) % bits) {
+			return false
+		}
+	}
+	return true
+}
+
+func newCompactSet(domains map[string]struct{}) *compactSet {
+	bits := uint64(len(domains)*bloomBitsPerEntry) + 64
+	c := &compactSet{
+		bloom:  make([]uint64, bits/64),
+		hashes: make([]uint64, 0, len(domains)),
+	}
+	bits = uint64(len(c.bloom)) * 64
+
+	for domain := range domains {
+		h := hashName(domain)
+		c.hashes = append(c.hashes, h)
+		bloomIndexes(h, bits, func(bit uint64) bool {
+			c.bloom[bit/64] |= 1 << (bit % 64)
+			return true
+		})
+	}
+	sort.Slice(c.hashes, func(i, j int) bool { return c.hashes[i] < c.hashes[j] })
+
+	return c
+}
+
+func (c *compactSet) contains(name string) bool {
+	h := hashName(name)
+
+	bits := uint64(len(c.bloom)) * 64
+	if !bloomIndexes(h, bits, func(bit uint64) bool {
+		return c.bloom[bit/64]&(1<<(bit%64)) != 0
+	}) {
+		return false
+	}
+
+	i := sort.Search(len(c.hashes), func(i int) bool { return c.hashes[i] >= h })
+	return i < len(c.hashes) && c.hashes[i] == h
+}
+
+// falsePositiveRates returns the estimated false positive rate of the bloom
+// filter alone and of the whole set.
+func (c *compactSet) falsePositiveRates() (bloom, total float64) {
+	n := float64(len(c.hashes))
+	m := float64(len(c.bloom) * 64)
+	bloom = math.Pow(1-math.Exp(-bloomHashes*n/m), bloomHashes)
+	// Names with colliding hashes always pass the bloom filter too.
+	return bloom, n / math.Pow(2, 64)
+}
+
+// sizeBytes returns the approximate amount of memory used by the set.
+func (c *compactSet) sizeBytes() int {
+	return 8 * (len(c.bloom) + len(c.hashes))
+}
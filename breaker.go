@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// States of a downstream circuit breaker.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// breakerConfig holds circuit_breaker_* options.
+type breakerConfig struct {
+	// Percentage of failed exchanges out of the last window ones that opens
+	// the circuit.
+	errorPercent int
+	window       int
+	cooldown     time.Duration
+}
+
+// circuitBreaker stops exchanges with a downstream that fails too often.
+//
+// While closed, outcomes of the last window exchanges are kept. Once at least
+// window exchanges were made and errorPercent of them failed, the circuit
+// opens and no queries are sent to the downstream for cooldown. After that
+// it is half-open: a single exchange is let through as a probe, which closes
+// the circuit if it succeeds and opens it again otherwise.
+type circuitBreaker struct {
+	lock  sync.Mutex
+	state string
+	// Outcomes of recent exchanges while closed, true for failures.
+	outcomes []bool
+	next     int
+	failures int
+	// When the cooldown of an open circuit ends.
+	openUntil time.Time
+	// Whether the probe of a half-open circuit is in flight.
+	probing bool
+}
+
+// allow reports whether an exchange can be started at now. If it returns
+// true, the outcome must be passed to record.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		return true
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// available reports whether allow would likely let an exchange through at
+// now, without starting one.
+func (b *circuitBreaker) available(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		return !now.Before(b.openUntil)
+	case circuitHalfOpen:
+		return !b.probing
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of an exchange allowed by
+// allow and returns the new state if it changed, an empty string otherwise.
+func (b *circuitBreaker) record(failed bool, now time.Time, cfg *breakerConfig) string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		// Exchange started before the circuit opened.
+		return ""
+	case circuitHalfOpen:
+		b.probing = false
+		if failed {
+			b.state = circuitOpen
+			b.openUntil = now.Add(cfg.cooldown)
+			return circuitOpen
+		}
+		b.reset()
+		return circuitClosed
+	}
+
+	if len(b.outcomes) < cfg.window {
+		b.outcomes = append(b.outcomes, failed)
+	} else {
+		if b.outcomes[b.next] {
+			b.failures--
+		}
+		b.outcomes[b.next] = failed
+		b.next = (b.next + 1) % cfg.window
+	}
+	if failed {
+		b.failures++
+	}
+
+	if len(b.outcomes) == cfg.window && b.failures*100 >= cfg.errorPercent*cfg.window {
+		b.reset()
+		b.state = circuitOpen
+		b.openUntil = now.Add(cfg.cooldown)
+		return circuitOpen
+	}
+	return ""
+}
+
+// abort is record for exchanges that were cancelled before they completed.
+func (b *circuitBreaker) abort() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == circuitHalfOpen {
+		b.probing = false
+	}
+}
+
+// reset closes the circuit and forgets recent outcomes, lock must be held.
+func (b *circuitBreaker) reset() {
+	b.state = circuitClosed
+	b.outcomes = b.outcomes[:0]
+	b.next = 0
+	b.failures = 0
+}
+
+// current returns the state of the circuit.
+func (b *circuitBreaker) current() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == "" {
+		return circuitClosed
+	}
+	return b.state
+}
+
+// recordExchange passes the outcome of an exchange with d to its circuit
+// breaker and logs state changes. Besides errors, SERVFAIL and REFUSED
+// responses count as failures: a downstream that cannot resolve anything
+// often still answers.
+func (s *Server) recordExchange(d *downstream, resp *dns.Msg, err error) {
+	// Exchanges cancelled because another downstream answered first (see
+	// exchangeParallel) say nothing about d.
+	if errors.Is(err, context.Canceled) {
+		d.breaker.abort()
+		return
+	}
+	if err == nil {
+		switch resp.Rcode {
+		case dns.RcodeServerFailure, dns.RcodeRefused:
+			err = fmt.Errorf("%s response", dns.RcodeToString[resp.Rcode])
+		}
+	}
+	state := d.breaker.record(err != nil, time.Now(), s.breaker)
+	switch state {
+	case circuitOpen:
+		log.Printf("Downstream %s circuit is open for %v: %v", d.name, s.breaker.cooldown, err)
+	case circuitClosed:
+		log.Printf("Downstream %s circuit is closed", d.name)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+
+	// Responses to queries with the DO bit set may include DNSSEC records
+	// that other clients did not ask for.
+	do bool
+	// Responses to queries with the CD bit set are not validated, see
+	// validateReply.
+	cd bool
+
+	// Set for views with their own downstreams.
+	view string
+	// Client subnet sent to downstreams, see ecsQuery.
+	ecs string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+
+	// Amount of times the entry was used, carried over when the response is
+	// refreshed.
+	hits int
+	// Set while a stale entry is being refreshed, so it is done only once.
+	refreshing bool
+}
+
+// Entries need to be used at least this many times before they are served
+// stale, others are just dropped when they expire.
+const staleMinHits = 2
+
+// TTL of records in stale responses (RFC 8767 recommends 30 seconds).
+const staleTTL = 30
+
+// responseCache is a fixed-size LRU cache of downstream responses.
+type responseCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+
+	// How long to cache SERVFAIL responses for, non-positive disables that.
+	servfailTTL time.Duration
+	// How long after expiry popular entries can still be served, see get.
+	maxStale time.Duration
+}
+
+func newResponseCache(size int, servfailTTL, maxStale time.Duration) *responseCache {
+	return &responseCache{
+		size:        size,
+		servfailTTL: servfailTTL,
+		maxStale:    maxStale,
+		entries:     make(map[cacheKey]*list.Element, size),
+		lru:         list.New(),
+	}
+}
+
+// msgTTL returns the amount of time msg can be cached for.
+//
+// Positive answers are cached for the minimum TTL of the answer section,
+// negative ones (NXDOMAIN, NODATA) use the SOA from the authority section as
+// described in RFC 2308. SERVFAIL responses are cached for the fixed
+// servfailTTL. ok is false if msg should not be cached at all.
+func (c *responseCache) msgTTL(msg *dns.Msg) (ttl time.Duration, ok bool) {
+	if msg.Truncated {
+		return 0, false
+	}
+
+	if msg.Rcode == dns.RcodeServerFailure {
+		return c.servfailTTL, c.servfailTTL > 0
+	}
+
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) != 0 {
+		minTTL := uint32(0)
+		for i, rr := range msg.Answer {
+			if i == 0 || rr.Header().Ttl < minTTL {
+				minTTL = rr.Header().Ttl
+			}
+		}
+		return time.Duration(minTTL) * time.Second, minTTL != 0
+	}
+
+	switch msg.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return 0, false
+	}
+
+	for _, rr := range msg.Ns {
+		soa, isSOA := rr.(*dns.SOA)
+		if !isSOA {
+			continue
+		}
+		minTTL := soa.Minttl
+		if soa.Hdr.Ttl < minTTL {
+			minTTL = soa.Hdr.Ttl
+		}
+		return time.Duration(minTTL) * time.Second, minTTL != 0
+	}
+
+	return 0, false
+}
+
+// clampTTLs limits TTLs of all records in msg (and SOA minimum TTLs, used for
+// negative caching) to [min, max], max of 0 means no upper limit.
+func clampTTLs(msg *dns.Msg, min, max uint32) {
+	clamp := func(ttl uint32) uint32 {
+		if ttl < min {
+			return min
+		}
+		if max != 0 && ttl > max {
+			return max
+		}
+		return ttl
+	}
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			hdr.Ttl = clamp(hdr.Ttl)
+			if soa, ok := rr.(*dns.SOA); ok {
+				soa.Minttl = clamp(soa.Minttl)
+			}
+		}
+	}
+}
+
+// get returns a copy of the cached response for key with TTLs adjusted for
+// the time it spent in the cache or nil if there is no usable entry.
+//
+// Expired entries that were used at least staleMinHits times are served for
+// up to maxStale after expiry with TTLs set to staleTTL. refresh is true
+// for the first such hit, the caller should then fetch a new response, put
+// it and call refreshDone.
+func (c *responseCache) get(key cacheKey) (msg *dns.Msg, refresh bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+
+	now := time.Now()
+	stale := now.After(entry.expires)
+	if stale && !c.canServeStale(entry, now) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	entry.hits++
+
+	msg = entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			switch {
+			case stale:
+				hdr.Ttl = staleTTL
+			case hdr.Ttl > elapsed:
+				hdr.Ttl -= elapsed
+			default:
+				hdr.Ttl = 0
+			}
+		}
+	}
+
+	if stale && !entry.refreshing {
+		entry.refreshing = true
+		return msg, true
+	}
+	return msg, false
+}
+
+func (c *responseCache) canServeStale(entry *cacheEntry, now time.Time) bool {
+	return c.maxStale > 0 &&
+		entry.hits >= staleMinHits &&
+		entry.msg.Rcode != dns.RcodeServerFailure &&
+		now.Before(entry.expires.Add(c.maxStale))
+}
+
+// refreshDone allows another refresh of the entry for key if it is still
+// stale, e.g. because the refresh failed.
+func (c *responseCache) refreshDone(key cacheKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).refreshing = false
+	}
+}
+
+func (c *responseCache) put(key cacheKey, msg *dns.Msg) {
+	ttl, ok := c.msgTTL(msg)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:     key,
+		msg:     msg.Copy(),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		entry.hits = elem.Value.(*cacheEntry).hits
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *responseCache) flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[cacheKey]*list.Element, c.size)
+	c.lru.Init()
+}
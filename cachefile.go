@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// savedEntry is the on-disk representation of a cacheEntry.
+type savedEntry struct {
+	Name    string
+	Qtype   uint16
+	Qclass  uint16
+	DO      bool
+	CD      bool
+	View    string
+	ECS     string
+	Msg     []byte
+	Stored  time.Time
+	Expires time.Time
+}
+
+// save writes unexpired cache entries to path, least recently used first.
+// The file is replaced atomically.
+func (c *responseCache) save(path string) (int, error) {
+	c.lock.Lock()
+	now := time.Now()
+	saved := make([]savedEntry, 0, c.lru.Len())
+	for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*cacheEntry)
+		if now.After(entry.expires) {
+			continue
+		}
+		wire, err := entry.msg.Pack()
+		if err != nil {
+			continue
+		}
+		saved = append(saved, savedEntry{
+			Name:    entry.key.name,
+			Qtype:   entry.key.qtype,
+			Qclass:  entry.key.qclass,
+			DO:      entry.key.do,
+			CD:      entry.key.cd,
+			View:    entry.key.view,
+			ECS:     entry.key.ecs,
+			Msg:     wire,
+			Stored:  entry.stored,
+			Expires: entry.expires,
+		})
+	}
+	c.lock.Unlock()
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".rhole-cache")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	if err := gob.NewEncoder(f).Encode(saved); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return len(saved), os.Rename(f.Name(), path)
+}
+
+// load adds entries saved to path, skipping expired ones. Nothing is added if
+// the file is corrupt.
+func (c *responseCache) load(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var saved []savedEntry
+	if err := gob.NewDecoder(f).Decode(&saved); err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+
+	now := time.Now()
+	entries := make([]*cacheEntry, 0, len(saved))
+	for _, se := range saved {
+		if now.After(se.Expires) || se.Stored.After(now) {
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(se.Msg); err != nil {
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+		entries = append(entries, &cacheEntry{
+			key: cacheKey{
+				name:   se.Name,
+				qtype:  se.Qtype,
+				qclass: se.Qclass,
+				do:     se.DO,
+				cd:     se.CD,
+				view:   se.View,
+				ecs:    se.ECS,
+			},
+			msg:     msg,
+			stored:  se.Stored,
+			expires: se.Expires,
+		})
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, entry := range entries {
+		if elem, ok := c.entries[entry.key]; ok {
+			elem.Value = entry
+			c.lru.MoveToFront(elem)
+			continue
+		}
+		c.entries[entry.key] = c.lru.PushFront(entry)
+		for c.lru.Len() > c.size {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*cacheEntry).key)
+		}
+	}
+	return len(entries), nil
+}
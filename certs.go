@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often GetCertificate checks modification times of certificate files.
+const certCheckInterval = 5 * time.Second
+
+// certReloader provides the certificate from certFile and keyFile for TLS
+// listeners and re-reads the files when they change, so renewed certificates
+// are used without a restart. If the new files cannot be loaded, the old
+// certificate is kept.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lock    sync.Mutex
+	cert    *tls.Certificate
+	checked time.Time
+	// Modification times of the files last time they were loaded, including
+	// failed attempts, so a broken renewal is not retried on each handshake.
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the certificate and key, lock must be held unless r is not
+// used by listeners yet.
+func (r *certReloader) load() error {
+	r.certMod, r.keyMod = modTime(r.certFile), modTime(r.keyFile)
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	r.cert = &cert
+
+	log.Printf("Loaded TLS certificate for %s, valid until %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// reload re-reads the files unconditionally, e.g. on SIGHUP.
+func (r *certReloader) reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.checked = time.Now()
+	return r.load()
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		if !modTime(r.certFile).Equal(r.certMod) || !modTime(r.keyFile).Equal(r.keyMod) {
+			if err := r.load(); err != nil {
+				log.Println("Failed to reload TLS certificate, keeping the old one:", err)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// modTime returns the modification time of the file or the zero time if it
+// cannot be determined.
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
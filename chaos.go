@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// chaosReply answers CHAOS class queries for the server version and
+// hostname, as used by monitoring tools. nil is returned for other queries
+// and for the version or hostname if it is not configured.
+func (s *Server) chaosReply(m *dns.Msg) *dns.Msg {
+	q := m.Question[0]
+	if q.Qclass != dns.ClassCHAOS {
+		return nil
+	}
+
+	var value string
+	switch strings.ToLower(q.Name) {
+	case "version.bind.", "version.server.":
+		value = s.chaosVersion
+	case "hostname.bind.", "id.server.":
+		value = s.chaosHostname
+	}
+	if value == "" {
+		return nil
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	reply.Authoritative = true
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+		reply.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassCHAOS,
+				Ttl:    0,
+			},
+			Txt: []string{value},
+		}}
+	}
+	return reply
+}
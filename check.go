@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// listSource is a single configured list or RPZ zone, read separately to
+// tell which of them matched a name.
+type listSource struct {
+	path     string
+	category string
+	black    *domainSet
+	white    *domainSet
+}
+
+func readListSources(cfg Config) ([]listSource, error) {
+	var sources []listSource
+	for _, path := range cfg.Blacklists {
+		set, err := readLists([]string{path}, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		sources = append(sources, listSource{path: path, black: set, white: newDomainSet()})
+	}
+	for _, path := range cfg.Whitelists {
+		set, err := readLists([]string{path}, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		sources = append(sources, listSource{path: path, black: newDomainSet(), white: set})
+	}
+	for _, c := range cfg.Categories {
+		for _, path := range c.Blacklists {
+			set, err := readLists([]string{path}, cfg)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			sources = append(sources, listSource{path: path, category: c.Name, black: set, white: newDomainSet()})
+		}
+	}
+	for _, path := range cfg.RPZZones {
+		black, white := newDomainSet(), newDomainSet()
+		if err := readRPZ([]string{path}, cfg, black, white, newRPZNODATASet()); err != nil {
+			return nil, err
+		}
+		sources = append(sources, listSource{path: path, black: black, white: white})
+	}
+	return sources, nil
+}
+
+// matchingSources returns descriptions of the sources whose blacklist (or
+// whitelist, if white is set) matches name. Sources from disabled categories
+// are skipped.
+func matchingSources(sources []listSource, name string, white, subdomains bool, disabled map[string]bool) []string {
+	var matched []string
+	for _, src := range sources {
+		if disabled[src.category] {
+			continue
+		}
+		set := src.black
+		if white {
+			set = src.white
+		}
+		rule, ok := set.match(name, subdomains)
+		if !ok {
+			continue
+		}
+		desc := fmt.Sprintf("%s in %s", describeRule(name, rule), src.path)
+		if src.category != "" {
+			desc += " (category " + src.category + ")"
+		}
+		matched = append(matched, desc)
+	}
+	return matched
+}
+
+func describeRule(name, rule string) string {
+	if rule == name {
+		return "entry " + rule
+	}
+	if strings.HasPrefix(rule, "*.") || strings.HasPrefix(rule, "/") {
+		return "rule " + rule
+	}
+	return "parent domain " + rule
+}
+
+// checkName writes the verdict for name to w: whether it would be blocked,
+// whitelisted or forwarded (and where to) using the global lists. Categories
+// are in their initial states.
+func checkName(w io.Writer, cfg Config, lists *domainLists, sources []listSource, name string) {
+	norm := normalize(name)
+	disabled := categoryStates(cfg.Categories)
+
+	if cfg.Mode == modeAllowlist {
+		if _, white := lists.white.match(norm, true); !white {
+			fmt.Fprintf(w, "%s: blocked (not whitelisted, mode allowlist)\n", name)
+			return
+		}
+		fmt.Fprintf(w, "%s: whitelisted\n", name)
+		for _, m := range matchingSources(sources, norm, true, true, disabled) {
+			fmt.Fprintf(w, "  %s\n", m)
+		}
+		return
+	}
+
+	_, _, black := lists.matchBlack(norm, cfg.BlockSubdomains, disabled)
+	if _, white := lists.white.match(norm, false); white {
+		fmt.Fprintf(w, "%s: whitelisted\n", name)
+		for _, m := range matchingSources(sources, norm, true, false, disabled) {
+			fmt.Fprintf(w, "  %s\n", m)
+		}
+		return
+	}
+	if black {
+		fmt.Fprintf(w, "%s: blocked\n", name)
+		for _, m := range matchingSources(sources, norm, false, cfg.BlockSubdomains, disabled) {
+			fmt.Fprintf(w, "  %s\n", m)
+		}
+		return
+	}
+
+	if d := lists.forwarder(norm); d != nil {
+		fmt.Fprintf(w, "%s: forwarded to %s (conditional forwarder)\n", name, d.name)
+		return
+	}
+	fmt.Fprintf(w, "%s: forwarded to %s\n", name, strings.Join(cfg.Downstreams, ", "))
+}
+
+// runCheck implements the check subcommand: it loads the configuration and
+// lists and prints verdicts for the names given in args without starting
+// the server.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	cfgPath := fs.String("config", "/etc/rhole.toml", "configuration file, directory or glob")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s check [-config path] domain...\n", os.Args[0])
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(*cfgPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	setStrictIDNA(cfg.StrictIDNA)
+	// Compact sets only save memory for the server.
+	cfg.CompactBlacklist = false
+	cfg.DumpEffectiveList = ""
+
+	lists, err := loadLists(cfg, categoryStates(cfg.Categories))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	// Everything worth logging was logged while reading lists above.
+	log.SetOutput(ioutil.Discard)
+	sources, err := readListSources(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	for _, name := range fs.Args() {
+		checkName(os.Stdout, cfg, lists, sources, name)
+	}
+	return 0
+}
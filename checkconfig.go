@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// runCheckConfig implements rhole --check-config: it loads the configuration
+// from paths and everything it refers to (lists, downstreams, views, local
+// records...) the same way the server does, but does not create any sockets.
+// Each problem is printed as a line starting with "error: ", the exit status
+// is 1 if there are any.
+func runCheckConfig(paths []string) int {
+	if len(paths) == 0 {
+		paths = []string{"/etc/rhole.toml"}
+	}
+
+	failed := false
+	report := func(err error) {
+		failed = true
+		var errs configErrors
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				fmt.Println("error:", e)
+			}
+			return
+		}
+		fmt.Println("error:", err)
+	}
+
+	cfg, err := loadConfig(paths...)
+	if err != nil {
+		report(err)
+		return 1
+	}
+	setStrictIDNA(cfg.StrictIDNA)
+	// Only check the configuration, do not write anything.
+	cfg.DumpEffectiveList = ""
+
+	lists, err := loadLists(cfg, categoryStates(cfg.Categories))
+	if err == nil {
+		err = checkBlacklist(cfg, lists)
+	}
+	if err != nil {
+		report(err)
+	}
+
+	timeouts := configTimeouts(cfg)
+	for _, entry := range cfg.Downstreams {
+		addr, _, err := splitWeight(entry)
+		if err == nil {
+			_, err = parseDownstream(addr, cfg.DownstreamNet, timeouts)
+		}
+		if err != nil {
+			report(err)
+		}
+	}
+	views, err := newViews(cfg, timeouts)
+	if err == nil {
+		_, err = loadViewLists(views, cfg)
+	}
+	if err != nil {
+		report(err)
+	}
+
+	if len(cfg.LocalRecords) != 0 {
+		if _, err := newLocalRecords(cfg.LocalRecords, cfg.LocalTTL, cfg.LocalPTR); err != nil {
+			report(err)
+		}
+	}
+	if cfg.ValidTLDs != "" {
+		if _, err := loadTLDs(cfg.ValidTLDs, cfg.InternalTLDs, cfg); err != nil {
+			report(fmt.Errorf("valid_tlds: %w", err))
+		}
+	}
+	if cfg.ValidateDNSSEC {
+		if _, err := newValidator(cfg.DNSSECTrustAnchors, nil); err != nil {
+			report(fmt.Errorf("dnssec_trust_anchors: %w", err))
+		}
+	}
+	if cfg.TLSCert != "" && cfg.TLSKey != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey); err != nil {
+			report(fmt.Errorf("tls_cert: %w", err))
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	fmt.Println("ok")
+	return 0
+}
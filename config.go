@@ -0,0 +1,397 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+)
+
+type Config struct {
+	Listen                stringList `toml:"listen"`
+	Recursion             bool       `toml:"recursion"`
+	ReusePort             bool       `toml:"reuseport"`
+	Listeners             int        `toml:"listeners"`
+	UDPReadBuffer         int        `toml:"udp_read_buffer"`
+	UDPWriteBuffer        int        `toml:"udp_write_buffer"`
+	TLSListen             stringList `toml:"tls_listen"`
+	TLSCert               string     `toml:"tls_cert"`
+	TLSKey                string     `toml:"tls_key"`
+	DoHListen             string     `toml:"doh_listen"`
+	DNSCryptListen        stringList `toml:"dnscrypt_listen"`
+	DNSCryptProviderName  string     `toml:"dnscrypt_provider_name"`
+	DNSCryptKeyFile       string     `toml:"dnscrypt_key_file"`
+	Downstreams           []string   `toml:"downstreams"`
+	DownstreamTimeoutSecs int        `toml:"downstream_timeout_secs"`
+	DialTimeoutSecs       int        `toml:"dial_timeout_secs"`
+	ReadTimeoutSecs       int        `toml:"read_timeout_secs"`
+	WriteTimeoutSecs      int        `toml:"write_timeout_secs"`
+	DownstreamNet         string     `toml:"downstream_net"`
+	DownstreamRetries     int        `toml:"downstream_retries"`
+	QnameMinimization     bool       `toml:"qname_minimization"`
+	CaseRandomization     bool       `toml:"case_randomization"`
+	Blacklists            []string   `toml:"blacklists"`
+	AllowEmptyBlacklist   bool       `toml:"allow_empty_blacklist"`
+	Whitelists            []string   `toml:"whitelists"`
+	RPZZones              []string   `toml:"rpz_zones"`
+	CacheSize             int        `toml:"cache_size"`
+	NegativeCacheSecs     int        `toml:"negative_cache_secs"`
+	CacheFile             string     `toml:"cache_file"`
+	MaxStaleSecs          int        `toml:"max_stale_secs"`
+	MinTTL                uint32     `toml:"min_ttl"`
+	MaxTTL                uint32     `toml:"max_ttl"`
+	BlockMode             string     `toml:"block_mode"`
+	BlockTTL              uint32     `toml:"block_ttl"`
+	SinkholeIPv4          string     `toml:"sinkhole_ipv4"`
+	SinkholeIPv6          string     `toml:"sinkhole_ipv6"`
+	BlockCNAME            string     `toml:"block_cname"`
+	ListFetchTimeoutSecs  int        `toml:"list_fetch_timeout_secs"`
+	ListCacheDir          string     `toml:"list_cache_dir"`
+	ListExtensions        []string   `toml:"list_extensions"`
+	ReloadIntervalSecs    int        `toml:"reload_interval_secs"`
+	ReloadJitterSecs      int        `toml:"reload_jitter_secs"`
+	MetricsListen         string     `toml:"metrics_listen"`
+	StatsListen           string     `toml:"stats_listen"`
+	ControlSocket         string     `toml:"control_socket"`
+	User                  string     `toml:"user"`
+	Group                 string     `toml:"group"`
+	QueryLog              string     `toml:"query_log"`
+	LogTarget             string     `toml:"log_target"`
+	ParallelDownstreams   int        `toml:"parallel_downstreams"`
+	MaxInflightDownstream int        `toml:"max_inflight_downstream"`
+	ShutdownTimeoutSecs   int        `toml:"shutdown_timeout_secs"`
+	EDNSUDPSize           int        `toml:"edns_udp_size"`
+	MaxUDPResponse        int        `toml:"max_udp_response"`
+	ECSMode               string     `toml:"ecs_mode"`
+	ECSPrefixV4           int        `toml:"ecs_prefix_v4"`
+	ECSPrefixV6           int        `toml:"ecs_prefix_v6"`
+
+	ChaosVersion  string `toml:"chaos_version"`
+	ChaosHostname string `toml:"chaos_hostname"`
+
+	ValidateDNSSEC     bool   `toml:"validate_dnssec"`
+	DNSSECTrustAnchors string `toml:"dnssec_trust_anchors"`
+
+	HealthCheckIntervalSecs   int    `toml:"health_check_interval_secs"`
+	HealthCheckName           string `toml:"health_check_name"`
+	HealthCheckMaxBackoffSecs int    `toml:"health_check_max_backoff_secs"`
+
+	CircuitBreakerErrorPercent int `toml:"circuit_breaker_error_percent"`
+	CircuitBreakerWindow       int `toml:"circuit_breaker_window"`
+	CircuitBreakerCooldownSecs int `toml:"circuit_breaker_cooldown_secs"`
+
+	AllowedClients []string `toml:"allowed_clients"`
+	ClientQPS      int      `toml:"client_qps"`
+	ClientBurst    int      `toml:"client_burst"`
+
+	ExternalPolicy          stringList `toml:"external_policy"`
+	ExternalPolicyTimeoutMs int        `toml:"external_policy_timeout_ms"`
+	ExternalPolicyCacheSecs int        `toml:"external_policy_cache_secs"`
+	ExternalPolicyMaxProcs  int        `toml:"external_policy_max_procs"`
+
+	BlockSubdomains  bool     `toml:"block_subdomains"`
+	MonitorMode      bool     `toml:"monitor_mode"`
+	Mode             string   `toml:"mode"`
+	BlockStatsSize   int      `toml:"block_stats_size"`
+	CNAMEUncloaking  bool     `toml:"cname_uncloaking"`
+	RegexLists       bool     `toml:"regex_lists"`
+	MaxRegexPatterns int      `toml:"max_regex_patterns"`
+	BlockQtypes      []string `toml:"block_qtypes"`
+	AnyQueryMode     string   `toml:"any_query_mode"`
+	CompactBlacklist bool     `toml:"compact_blacklist"`
+	StrictIDNA       bool     `toml:"strict_idna"`
+
+	DumpEffectiveList string `toml:"dump_effective_list"`
+	BlacklistDB       string `toml:"blacklist_db"`
+	StartupMode       string `toml:"startup_mode"`
+
+	BlockSOA BlockSOAConfig `toml:"block_soa"`
+
+	Views []ViewConfig `toml:"views"`
+
+	Categories []CategoryConfig `toml:"categories"`
+
+	LocalRecords map[string]stringList `toml:"local_records"`
+	LocalTTL     uint32                `toml:"local_ttl"`
+	LocalPTR     bool                  `toml:"local_ptr"`
+
+	BlockPrivatePTR       bool `toml:"block_private_ptr"`
+	StripDNSSECForClients bool `toml:"strip_dnssec_for_clients"`
+
+	ValidTLDs    string   `toml:"valid_tlds"`
+	InternalTLDs []string `toml:"internal_tlds"`
+
+	RebindProtection     string   `toml:"rebind_protection"`
+	RebindAllowedDomains []string `toml:"rebind_allowed_domains"`
+
+	// Files the configuration was read from, set by loadConfig.
+	files []string
+}
+
+// BlockSOAConfig contains values for the SOA record used in synthesized
+// negative responses for blocked domains.
+type BlockSOAConfig struct {
+	TTL    uint32 `toml:"ttl"`
+	Ns     string `toml:"ns"`
+	Mbox   string `toml:"mbox"`
+	Minttl uint32 `toml:"minttl"`
+	Owner  string `toml:"owner"`
+}
+
+// ViewConfig describes lists and downstreams used for queries from certain
+// client networks instead of the global ones.
+type ViewConfig struct {
+	Name        string   `toml:"name"`
+	Clients     []string `toml:"clients"`
+	Blacklists  []string `toml:"blacklists"`
+	Whitelists  []string `toml:"whitelists"`
+	Downstreams []string `toml:"downstreams"`
+
+	BlockMode    string `toml:"block_mode"`
+	SinkholeIPv4 string `toml:"sinkhole_ipv4"`
+	SinkholeIPv6 string `toml:"sinkhole_ipv6"`
+	BlockCNAME   string `toml:"block_cname"`
+}
+
+// CategoryConfig describes a group of blacklists that can be disabled and
+// enabled at runtime using the control socket.
+type CategoryConfig struct {
+	Name       string   `toml:"name"`
+	Blacklists []string `toml:"blacklists"`
+	// Initial state.
+	Disabled bool `toml:"disabled"`
+}
+
+// configFiles expands a configuration path: directories stand for all *.toml
+// files in them, other paths can be glob patterns. Files are sorted by name.
+func configFiles(path string) ([]string, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, "*.toml")
+	} else if err == nil {
+		return []string{path}, nil
+	}
+
+	files, err := filepath.Glob(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(files) == 0 && !strings.ContainsAny(path, "*?[") {
+		return nil, fmt.Errorf("%s: no such file or directory", path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// decodeConfigs decodes files into cfg in order. Later files override
+// options set by earlier ones, except for lists (arrays and arrays of
+// tables), which are appended to. Tables are merged key by key. Keys defined
+// in any of the files are returned, both top-level ones and dotted keys of
+// tables (e.g. block_soa.ttl).
+func decodeConfigs(files []string, cfg *Config) (map[string]bool, error) {
+	defined := make(map[string]bool)
+	merged := reflect.ValueOf(cfg).Elem()
+	for _, file := range files {
+		// Decoding into cfg overrides only options present in the file. Lists
+		// are decoded separately and appended, since the decoder reuses
+		// existing slices.
+		prev := make([]reflect.Value, merged.NumField())
+		for i := range prev {
+			if field := merged.Field(i); field.Kind() == reflect.Slice && field.CanSet() {
+				prev[i] = reflect.ValueOf(field.Interface())
+				field.Set(reflect.Zero(field.Type()))
+			}
+		}
+
+		md, err := toml.DecodeFile(file, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		for _, key := range md.Keys() {
+			defined[key[0]] = true
+			defined[key.String()] = true
+		}
+
+		for i, old := range prev {
+			if old.IsValid() {
+				field := merged.Field(i)
+				field.Set(reflect.AppendSlice(old, field))
+			}
+		}
+	}
+	return defined, nil
+}
+
+// loadConfig reads the configuration from paths (see configFiles and
+// decodeConfigs), fills in defaults for options that are not set and checks
+// the result using validateConfig.
+func loadConfig(paths ...string) (Config, error) {
+	var files []string
+	for _, path := range paths {
+		expanded, err := configFiles(path)
+		if err != nil {
+			return Config{}, err
+		}
+		files = append(files, expanded...)
+	}
+	if len(files) == 0 {
+		return Config{}, errors.New("no configuration files")
+	}
+
+	var cfg Config
+	defined, err := decodeConfigs(files, &cfg)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg.files = files
+
+	if !defined["recursion"] {
+		cfg.Recursion = true
+	}
+	if cfg.ListFetchTimeoutSecs == 0 {
+		cfg.ListFetchTimeoutSecs = 30
+	}
+	if cfg.ListCacheDir == "" {
+		cfg.ListCacheDir = "/var/cache/rhole"
+	}
+	if cfg.LogTarget == "" {
+		cfg.LogTarget = "stderr"
+	}
+	if cfg.Listeners == 0 {
+		cfg.Listeners = 1
+	}
+	if cfg.DownstreamNet == "" {
+		cfg.DownstreamNet = "udp"
+	}
+	if cfg.DownstreamTimeoutSecs == 0 {
+		cfg.DownstreamTimeoutSecs = 5
+	}
+	if cfg.DialTimeoutSecs == 0 {
+		cfg.DialTimeoutSecs = cfg.DownstreamTimeoutSecs
+	}
+	if cfg.ReadTimeoutSecs == 0 {
+		cfg.ReadTimeoutSecs = cfg.DownstreamTimeoutSecs
+	}
+	if cfg.WriteTimeoutSecs == 0 {
+		cfg.WriteTimeoutSecs = cfg.DownstreamTimeoutSecs
+	}
+	if cfg.MaxRegexPatterns == 0 {
+		cfg.MaxRegexPatterns = 100
+	}
+	if cfg.NegativeCacheSecs == 0 {
+		cfg.NegativeCacheSecs = 5
+	}
+	if cfg.ShutdownTimeoutSecs == 0 {
+		cfg.ShutdownTimeoutSecs = 5
+	}
+	if cfg.EDNSUDPSize == 0 {
+		cfg.EDNSUDPSize = 1232
+	}
+	if cfg.MaxUDPResponse == 0 {
+		cfg.MaxUDPResponse = 1232
+	}
+	if cfg.ECSMode == "" {
+		cfg.ECSMode = ecsStrip
+	}
+	if cfg.ECSPrefixV4 == 0 {
+		cfg.ECSPrefixV4 = 24
+	}
+	if cfg.ECSPrefixV6 == 0 {
+		cfg.ECSPrefixV6 = 56
+	}
+	if cfg.HealthCheckName == "" {
+		cfg.HealthCheckName = "."
+	}
+	if cfg.HealthCheckMaxBackoffSecs == 0 {
+		cfg.HealthCheckMaxBackoffSecs = 300
+	}
+	if cfg.CircuitBreakerWindow == 0 {
+		cfg.CircuitBreakerWindow = 20
+	}
+	if cfg.CircuitBreakerCooldownSecs == 0 {
+		cfg.CircuitBreakerCooldownSecs = 30
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = modeBlocklist
+	}
+	if cfg.BlockMode == "" {
+		cfg.BlockMode = blockNXDOMAIN
+	}
+	if cfg.BlockTTL == 0 {
+		cfg.BlockTTL = 60
+	}
+	if cfg.RebindProtection == "" {
+		cfg.RebindProtection = rebindOff
+	}
+	if cfg.AnyQueryMode == "" {
+		cfg.AnyQueryMode = anyHINFO
+	}
+	if cfg.LocalTTL == 0 {
+		cfg.LocalTTL = 300
+	}
+	// 0 is a valid TTL, so only missing keys get defaults.
+	if !defined["block_soa.ttl"] {
+		cfg.BlockSOA.TTL = 9999
+	}
+	if cfg.BlockSOA.Ns == "" {
+		cfg.BlockSOA.Ns = "invalid."
+	}
+	if cfg.BlockSOA.Mbox == "" {
+		cfg.BlockSOA.Mbox = "hostmaster.invalid."
+	}
+	if !defined["block_soa.minttl"] {
+		cfg.BlockSOA.Minttl = 60
+	}
+	if cfg.StartupMode == "" {
+		cfg.StartupMode = startupWait
+	}
+	if cfg.BlockSOA.Owner == "" {
+		cfg.BlockSOA.Owner = soaOwnerQname
+	}
+	if cfg.ExternalPolicyTimeoutMs == 0 {
+		cfg.ExternalPolicyTimeoutMs = 200
+	}
+	if cfg.ExternalPolicyCacheSecs == 0 {
+		cfg.ExternalPolicyCacheSecs = 10
+	}
+	if cfg.ExternalPolicyMaxProcs == 0 {
+		cfg.ExternalPolicyMaxProcs = 16
+	}
+	cfg.BlockSOA.Ns = dns.Fqdn(cfg.BlockSOA.Ns)
+	cfg.BlockSOA.Mbox = dns.Fqdn(cfg.BlockSOA.Mbox)
+
+	if err := validateConfig(cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// stringList is a list of strings that can also be specified as a single
+// string in the configuration.
+type stringList []string
+
+func (l *stringList) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*l = stringList{v}
+	case []interface{}:
+		list := make(stringList, 0, len(v))
+		for _, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected a string, got %T", item)
+			}
+			list = append(list, str)
+		}
+		*l = list
+	default:
+		return fmt.Errorf("expected a string or a list of strings, got %T", v)
+	}
+	return nil
+}
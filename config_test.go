@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfigs writes files to a temporary directory and returns its path,
+// "$DIR" in the files is replaced with it.
+func writeConfigs(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "rhole-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(strings.ReplaceAll(content, "$DIR", dir)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadConfigMerge(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"10-base.toml": `listen = "127.0.0.1:5300"
+downstreams = ["192.0.2.1"]
+blacklists = ["$DIR/base.txt"]
+cache_size = 10
+block_ttl = 30
+
+[block_soa]
+ttl = 100
+
+[[views]]
+name = "kids"
+clients = ["192.0.2.0/24"]
+`,
+		"20-local.toml": `downstreams = ["192.0.2.2"]
+blacklists = ["$DIR/local.txt"]
+cache_size = 20
+
+[block_soa]
+minttl = 0
+
+[[views]]
+name = "guests"
+clients = ["198.51.100.0/24"]
+`,
+		"base.txt":  "base.example.com\n",
+		"local.txt": "local.example.com\n",
+		// Not a configuration file.
+		"notes.txt": `cache_size = 30`,
+	})
+
+	check := func(name string, cfg Config) {
+		if expected := []string{"192.0.2.1", "192.0.2.2"}; !reflect.DeepEqual(cfg.Downstreams, expected) {
+			t.Errorf("%s: downstreams are %v, expected %v", name, cfg.Downstreams, expected)
+		}
+		if expected := []string{filepath.Join(dir, "base.txt"), filepath.Join(dir, "local.txt")}; !reflect.DeepEqual(cfg.Blacklists, expected) {
+			t.Errorf("%s: blacklists are %v, expected %v", name, cfg.Blacklists, expected)
+		}
+		if cfg.CacheSize != 20 {
+			t.Errorf("%s: cache_size is %d, expected 20", name, cfg.CacheSize)
+		}
+		// Set only by the first file.
+		if cfg.BlockTTL != 30 {
+			t.Errorf("%s: block_ttl is %d, expected 30", name, cfg.BlockTTL)
+		}
+		if cfg.BlockSOA.TTL != 100 || cfg.BlockSOA.Minttl != 0 {
+			t.Errorf("%s: block_soa ttl is %d and minttl %d, expected 100 and 0", name, cfg.BlockSOA.TTL, cfg.BlockSOA.Minttl)
+		}
+		if len(cfg.Views) != 2 || cfg.Views[0].Name != "kids" || cfg.Views[1].Name != "guests" {
+			t.Errorf("%s: views are %+v, expected kids and guests", name, cfg.Views)
+		}
+	}
+
+	cfg, err := loadConfig(filepath.Join(dir, "10-base.toml"), filepath.Join(dir, "20-local.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("files", cfg)
+
+	cfg, err = loadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("directory", cfg)
+	if expected := []string{filepath.Join(dir, "10-base.toml"), filepath.Join(dir, "20-local.toml")}; !reflect.DeepEqual(cfg.files, expected) {
+		t.Errorf("directory: files are %v, expected %v", cfg.files, expected)
+	}
+
+	// Files are decoded in the order given.
+	cfg, err = loadConfig(filepath.Join(dir, "20-local.toml"), filepath.Join(dir, "10-base.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CacheSize != 10 {
+		t.Errorf("reversed: cache_size is %d, expected 10", cfg.CacheSize)
+	}
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	dir := writeConfigs(t, nil)
+	if _, err := loadConfig(filepath.Join(dir, "missing.toml")); err == nil {
+		t.Error("missing file: no error")
+	}
+	if _, err := loadConfig(dir); err == nil {
+		t.Error("empty directory: no error")
+	}
+}
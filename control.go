@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenControl creates the control socket at path. The socket is
+// accessible only by the owner.
+func (s *Server) listenControl(path string) error {
+	// Remove the socket left by a previous instance.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	// The socket is created with the permissions allowed by umask, so
+	// restrict it for the Listen call instead of changing them later and
+	// leaving a window in which anyone can connect.
+	oldMask := unix.Umask(0077)
+	l, err := net.Listen("unix", path)
+	unix.Umask(oldMask)
+	if err != nil {
+		return err
+	}
+	s.controlL = l
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				select {
+				case <-s.stop:
+				default:
+					log.Println("Control socket failed:", err)
+				}
+				return
+			}
+			go s.serveControl(conn)
+		}
+	}()
+	return nil
+}
+
+// serveControl handles control commands, one per line. Each command gets a
+// response ending with "OK" or "ERR <message>" line.
+//
+//	reload           re-read lists
+//	stats            print statistics as JSON
+//	flush-cache      remove all cached responses
+//	block <name>     block the name until restart
+//	unblock <name>   do not block the name until restart
+//	clear <name>     remove the block or unblock override of the name
+//	reset            remove all block and unblock overrides
+func (s *Server) serveControl(conn net.Conn) {
+	defer conn.Close()
+
+	scnr := bufio.NewScanner(conn)
+	for scnr.Scan() {
+		fields := strings.Fields(scnr.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := s.controlCommand(conn, fields[0], fields[1:]); err != nil {
+			fmt.Fprintln(conn, "ERR", err)
+			continue
+		}
+		fmt.Fprintln(conn, "OK")
+	}
+}
+
+func (s *Server) controlCommand(w io.Writer, cmd string, args []string) error {
+	switch cmd {
+	case "reload":
+		return s.reloadLists()
+	case "stats":
+		return json.NewEncoder(w).Encode(s.stats(10))
+	case "flush-cache":
+		if s.cache != nil {
+			s.cache.flush()
+		}
+		return nil
+	case "categories":
+		s.listsLock.RLock()
+		defer s.listsLock.RUnlock()
+		if s.lists == nil {
+			return fmt.Errorf("lists are not loaded yet")
+		}
+		for _, c := range s.lists.categories {
+			state := "enabled"
+			if s.disabledCategories[c.name] {
+				state = "disabled"
+			}
+			fmt.Fprintln(w, c.name, state, c.black.size())
+		}
+		return nil
+	case "enable", "disable":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s <category>", cmd)
+		}
+		if err := s.setCategoryDisabled(args[0], cmd == "disable"); err != nil {
+			return err
+		}
+		log.Printf("Runtime override: %s category %s", cmd, args[0])
+		return nil
+	case "block", "unblock":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s <name>", cmd)
+		}
+		name := normalize(args[0])
+		s.setOverride(name, cmd == "block")
+		log.Printf("Runtime override: %s %s", cmd, name)
+		return nil
+	case "clear":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s <name>", cmd)
+		}
+		name := normalize(args[0])
+		if !s.clearOverride(name) {
+			return fmt.Errorf("no override for %s", name)
+		}
+		log.Printf("Runtime override: cleared %s", name)
+		return nil
+	case "reset":
+		if len(args) != 0 {
+			return fmt.Errorf("usage: %s", cmd)
+		}
+		log.Printf("Runtime override: cleared %d names", s.resetOverrides())
+		return nil
+	default:
+		return fmt.Errorf("unknown command: %s", cmd)
+	}
+}
+
+func (s *Server) setCategoryDisabled(name string, disabled bool) error {
+	s.listsLock.Lock()
+	defer s.listsLock.Unlock()
+	if _, ok := s.disabledCategories[name]; !ok {
+		return fmt.Errorf("unknown category: %s", name)
+	}
+	s.disabledCategories[name] = disabled
+	return nil
+}
+
+// setOverride makes isBlocked return blocked for the normalized name,
+// regardless of lists.
+func (s *Server) setOverride(name string, blocked bool) {
+	s.listsLock.Lock()
+	defer s.listsLock.Unlock()
+	s.overrides[name] = blocked
+}
+
+// clearOverride removes the override set by setOverride for the normalized
+// name and reports whether there was one.
+func (s *Server) clearOverride(name string) bool {
+	s.listsLock.Lock()
+	defer s.listsLock.Unlock()
+	_, ok := s.overrides[name]
+	delete(s.overrides, name)
+	return ok
+}
+
+// resetOverrides removes all overrides and returns their number.
+func (s *Server) resetOverrides() int {
+	s.listsLock.Lock()
+	defer s.listsLock.Unlock()
+	n := len(s.overrides)
+	s.overrides = make(map[string]bool)
+	return n
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// DNSCrypt v2 protocol constants, see https://dnscrypt.info/protocol. Only
+// the X25519-XSalsa20Poly1305 construction is supported, all clients
+// implement it.
+const (
+	dnscryptCertMagic     = "DNSC"
+	dnscryptResolverMagic = "r6fnvWj8"
+	dnscryptESVersion     = 1
+	// Client magic, client public key and half of the nonce.
+	dnscryptQueryHeader = 8 + 32 + 12
+	// Resolver magic and full nonce.
+	dnscryptResponseHeader = 8 + 24
+	dnscryptPadBlock       = 64
+
+	// Resolver keys are short-lived: a new certificate is issued every
+	// dnscryptRotateInterval and the previous one is still accepted until it
+	// expires, so clients have time to fetch the new one.
+	dnscryptCertValidity   = 24 * time.Hour
+	dnscryptRotateInterval = 12 * time.Hour
+
+	// Idle timeout for DNSCrypt TCP connections.
+	dnscryptTCPTimeout = 10 * time.Second
+)
+
+// dnscryptCert is a resolver key pair along with the certificate for it
+// signed by the provider key.
+type dnscryptCert struct {
+	magic   [8]byte
+	public  [32]byte
+	private [32]byte
+	raw     []byte
+	expires time.Time
+}
+
+func newDNSCryptCert(providerKey ed25519.PrivateKey, now time.Time) (*dnscryptCert, error) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	c := &dnscryptCert{
+		public:  *public,
+		private: *private,
+		expires: now.Add(dnscryptCertValidity),
+	}
+	copy(c.magic[:], public[:8])
+
+	signed := make([]byte, 0, 32+8+12)
+	signed = append(signed, c.public[:]...)
+	signed = append(signed, c.magic[:]...)
+	var fields [12]byte
+	// Serial, start and end of the validity period. The start is moved back
+	// a bit in case clients' clocks are behind.
+	binary.BigEndian.PutUint32(fields[0:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(fields[4:], uint32(now.Add(-time.Hour).Unix()))
+	binary.BigEndian.PutUint32(fields[8:], uint32(c.expires.Unix()))
+	signed = append(signed, fields[:]...)
+
+	c.raw = append([]byte(dnscryptCertMagic), 0, dnscryptESVersion, 0, 0)
+	c.raw = append(c.raw, ed25519.Sign(providerKey, signed)...)
+	c.raw = append(c.raw, signed...)
+	return c, nil
+}
+
+// dnscryptServer serves DNSCrypt queries on dnscrypt_listen addresses,
+// decrypted queries are processed by ServeDNS.
+type dnscryptServer struct {
+	s *Server
+	// Lowercase FQDN, e.g. 2.dnscrypt-cert.example.org.
+	providerName string
+	providerKey  ed25519.PrivateKey
+
+	lock sync.RWMutex
+	// Current certificate first, then the previous one, if any.
+	certs []*dnscryptCert
+
+	packetConns []net.PacketConn
+	listeners   []net.Listener
+}
+
+func newDNSCrypt(s *Server, providerName, keyFile string) (*dnscryptServer, error) {
+	key, err := loadProviderKey(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("dnscrypt_key_file: %w", err)
+	}
+	d := &dnscryptServer{
+		s:            s,
+		providerName: strings.ToLower(dns.Fqdn(providerName)),
+		providerKey:  key,
+	}
+	if err := d.rotate(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// loadProviderKey reads the hex-encoded Ed25519 seed of the provider key from
+// path, generating and saving a new one if the file does not exist.
+func loadProviderKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(seed)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Println("Generated DNSCrypt provider key in", path)
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: key must be %d bytes, got %d", path, ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// rotate issues a new certificate, keeping the previous one.
+func (d *dnscryptServer) rotate() error {
+	cert, err := newDNSCryptCert(d.providerKey, time.Now())
+	if err != nil {
+		return fmt.Errorf("dnscrypt: %w", err)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.certs = append([]*dnscryptCert{cert}, d.certs...)
+	if len(d.certs) > 2 {
+		d.certs = d.certs[:2]
+	}
+	return nil
+}
+
+func (d *dnscryptServer) rotateLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(dnscryptRotateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if err := d.rotate(); err != nil {
+			log.Println("Failed to rotate DNSCrypt certificate:", err)
+		}
+	}
+}
+
+// stamp returns the DNS stamp (sdns://) that clients use to connect to addr.
+func (d *dnscryptServer) stamp(addr string) string {
+	// Protocol 0x01 (DNSCrypt) and no properties.
+	b := []byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0}
+	public := d.providerKey.Public().(ed25519.PublicKey)
+	for _, field := range [][]byte{[]byte(addr), public, []byte(strings.TrimSuffix(d.providerName, "."))} {
+		b = append(b, byte(len(field)))
+		b = append(b, field...)
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// listen creates UDP and TCP sockets for DNSCrypt on addr, which can end with
+// @interface as for listen.
+func (d *dnscryptServer) listen(addr string, reusePort bool) error {
+	addr, iface := splitInterface(addr)
+	lc := net.ListenConfig{
+		Control: socketControl(iface, reusePort),
+	}
+
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return err
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	d.listeners = append(d.listeners, l)
+	d.packetConns = append(d.packetConns, pc)
+
+	log.Printf("DNSCrypt provider %s on %s, stamp: %s",
+		strings.TrimSuffix(d.providerName, "."), addr, d.stamp(addr))
+	return nil
+}
+
+// serve runs all DNSCrypt listeners and blocks until they are closed.
+func (d *dnscryptServer) serve() {
+	go d.rotateLoop(d.s.stop)
+
+	var wg sync.WaitGroup
+	for _, pc := range d.packetConns {
+		wg.Add(1)
+		go func(pc net.PacketConn) {
+			defer wg.Done()
+			d.serveUDP(pc)
+		}(pc)
+	}
+	for _, l := range d.listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			d.serveTCP(l)
+		}(l)
+	}
+	wg.Wait()
+}
+
+func (d *dnscryptServer) close() {
+	for _, pc := range d.packetConns {
+		pc.Close()
+	}
+	for _, l := range d.listeners {
+		l.Close()
+	}
+}
+
+// stopping reports whether the server is shutting down, so errors from closed
+// sockets are not logged.
+func (d *dnscryptServer) stopping() bool {
+	select {
+	case <-d.s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *dnscryptServer) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !d.stopping() {
+				log.Println("DNSCrypt server failed:", err)
+			}
+			return
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp := d.handle(packet, false, pc.LocalAddr(), addr)
+			if resp == nil {
+				return
+			}
+			if _, err := pc.WriteTo(resp, addr); err != nil {
+				log.Printf("WriteMsg: %v", err)
+			}
+		}()
+	}
+}
+
+func (d *dnscryptServer) serveTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !d.stopping() {
+				log.Println("DNSCrypt server failed:", err)
+			}
+			return
+		}
+		go d.serveConn(conn)
+	}
+}
+
+// serveConn handles length-prefixed messages on the TCP connection until the
+// client closes it or it is idle for dnscryptTCPTimeout.
+func (d *dnscryptServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for !d.stopping() {
+		conn.SetDeadline(time.Now().Add(dnscryptTCPTimeout))
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		packet := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, packet); err != nil {
+			return
+		}
+
+		resp := d.handle(packet, true, conn.LocalAddr(), conn.RemoteAddr())
+		if resp == nil {
+			return
+		}
+		out := make([]byte, 2, 2+len(resp))
+		binary.BigEndian.PutUint16(out, uint16(len(resp)))
+		if _, err := conn.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// cert returns the certificate with the client magic from the query, nil if
+// there is none, e.g. it is a plain DNS query for the certificate.
+func (d *dnscryptServer) cert(packet []byte) *dnscryptCert {
+	if len(packet) < dnscryptQueryHeader+box.Overhead {
+		return nil
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	for _, c := range d.certs {
+		if bytes.Equal(packet[:8], c.magic[:]) {
+			return c
+		}
+	}
+	return nil
+}
+
+// handle returns the response to the packet received from remote or nil if
+// it should be dropped.
+func (d *dnscryptServer) handle(packet []byte, tcp bool, local, remote net.Addr) []byte {
+	c := d.cert(packet)
+	if c == nil {
+		return d.handlePlain(packet)
+	}
+
+	var clientKey, shared [32]byte
+	copy(clientKey[:], packet[8:40])
+	box.Precompute(&shared, &clientKey, &c.private)
+	var nonce [24]byte
+	copy(nonce[:12], packet[40:dnscryptQueryHeader])
+
+	padded, ok := box.OpenAfterPrecomputation(nil, packet[dnscryptQueryHeader:], &nonce, &shared)
+	if !ok {
+		return nil
+	}
+	wire, err := unpad(padded)
+	if err != nil {
+		return nil
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(wire); err != nil || req.Response {
+		return nil
+	}
+
+	w := &dohWriter{local: local, remote: remote}
+	d.s.ServeDNS(w, req)
+	if w.resp == nil {
+		return nil
+	}
+	out, err := w.resp.Pack()
+	if err != nil {
+		log.Println("Failed to pack DNSCrypt response:", err)
+		return nil
+	}
+
+	// UDP responses must not be larger than the query to prevent
+	// amplification, the client retries over TCP.
+	if !tcp && dnscryptResponseHeader+box.Overhead+paddedLen(len(out)) > len(packet) {
+		tc := new(dns.Msg)
+		tc.SetReply(req)
+		tc.Truncated = true
+		if out, err = tc.Pack(); err != nil {
+			return nil
+		}
+	}
+
+	if _, err := rand.Read(nonce[12:]); err != nil {
+		return nil
+	}
+	resp := make([]byte, 0, dnscryptResponseHeader+box.Overhead+paddedLen(len(out)))
+	resp = append(resp, dnscryptResolverMagic...)
+	resp = append(resp, nonce[:]...)
+	return box.SealAfterPrecomputation(resp, pad(out), &nonce, &shared)
+}
+
+// handlePlain answers unencrypted queries for the provider certificates,
+// other plain DNS queries are refused.
+func (d *dnscryptServer) handlePlain(packet []byte) []byte {
+	req := new(dns.Msg)
+	if err := req.Unpack(packet); err != nil || req.Response || len(req.Question) != 1 {
+		return nil
+	}
+	q := req.Question[0]
+
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	if q.Qtype != dns.TypeTXT || strings.ToLower(q.Name) != d.providerName {
+		reply.Rcode = dns.RcodeRefused
+	} else {
+		d.lock.RLock()
+		for _, c := range d.certs {
+			reply.Answer = append(reply.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypeTXT,
+					Class:  dns.ClassINET,
+					// Clients should re-fetch certificates before the current
+					// one is rotated.
+					Ttl: uint32(dnscryptRotateInterval / time.Second),
+				},
+				Txt: []string{escapeTXT(c.raw)},
+			})
+		}
+		d.lock.RUnlock()
+	}
+
+	out, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// escapeTXT converts binary data to the presentation format of a TXT string
+// used by dns.TXT.
+func escapeTXT(data []byte) string {
+	var b strings.Builder
+	for _, c := range data {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// paddedLen returns the length of a message of length n after pad.
+func paddedLen(n int) int {
+	return (n/dnscryptPadBlock + 1) * dnscryptPadBlock
+}
+
+// pad appends 0x80 and zeros to msg up to a multiple of dnscryptPadBlock.
+func pad(msg []byte) []byte {
+	out := make([]byte, paddedLen(len(msg)))
+	copy(out, msg)
+	out[len(msg)] = 0x80
+	return out
+}
+
+func unpad(padded []byte) ([]byte, error) {
+	indx := bytes.LastIndexByte(padded, 0x80)
+	if indx == -1 {
+		return nil, errors.New("missing padding")
+	}
+	for _, c := range padded[indx+1:] {
+		if c != 0 {
+			return nil, errors.New("invalid padding")
+		}
+	}
+	return padded[:indx], nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// isDnsmasqDirective reports whether line is a dnsmasq.conf(5) directive
+// understood by parseDnsmasq.
+func isDnsmasqDirective(line string) bool {
+	return strings.HasPrefix(line, "address=") || strings.HasPrefix(line, "server=")
+}
+
+// parseDnsmasqDomains splits "/domain1/domain2/value" into the domains and
+// the value.
+func parseDnsmasqDomains(spec string) ([]string, string, error) {
+	if !strings.HasPrefix(spec, "/") {
+		return nil, "", errors.New("expected /domain/")
+	}
+	parts := strings.Split(spec[1:], "/")
+	if len(parts) < 2 {
+		return nil, "", errors.New("expected /domain/")
+	}
+	domains, value := parts[:len(parts)-1], parts[len(parts)-1]
+	for _, d := range domains {
+		if d == "" {
+			return nil, "", errors.New("empty domain")
+		}
+	}
+	return domains, value, nil
+}
+
+// parseDnsmasq handles address=/domain/[ip] and server=/domain/ip[#port]
+// lines. Addresses are ignored and the domains are added to the set along
+// with their subdomains, as dnsmasq matches them, server lines add conditional
+// forwarders.
+func parseDnsmasq(line string, set *domainSet) error {
+	directive := line[:strings.Index(line, "=")]
+	domains, value, err := parseDnsmasqDomains(line[len(directive)+1:])
+	if err != nil {
+		return err
+	}
+
+	switch directive {
+	case "address":
+		if value != "" && value != "#" && net.ParseIP(value) == nil {
+			return fmt.Errorf("invalid address: %s", value)
+		}
+		for _, d := range domains {
+			domain := set.normalizeEntry(d)
+			set.add(domain)
+			set.addWildcard(domain)
+		}
+	case "server":
+		ip := value
+		if indx := strings.Index(value, "#"); indx != -1 {
+			ip = value[:indx]
+		}
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid server address: %s", value)
+		}
+		if set.forwarders == nil {
+			set.forwarders = make(map[string]string)
+		}
+		for _, d := range domains {
+			set.forwarders[set.normalizeEntry(d)] = value
+		}
+	}
+	return nil
+}
+
+// parseForwarder creates the downstream for the ip[#port] value of a server=
+// line.
+func parseForwarder(value, network string, timeouts downstreamTimeouts) (*downstream, error) {
+	ip, port := value, ""
+	if indx := strings.Index(value, "#"); indx != -1 {
+		ip, port = value[:indx], value[indx+1:]
+	}
+	d, err := parseDownstream(ip, network, timeouts)
+	if err != nil {
+		return nil, err
+	}
+	d.name = value
+	if port != "" {
+		d.addr = net.JoinHostPort(ip, port)
+	}
+	return d, nil
+}
+
+// forwarder returns the conditional forwarder for the longest matching
+// suffix of name in lists of view v or nil if there is none.
+func (s *Server) forwarder(v *view, name string) *downstream {
+	s.listsLock.RLock()
+	defer s.listsLock.RUnlock()
+
+	if l := s.listsFor(v); l != nil {
+		return l.forwarder(name)
+	}
+	return nil
+}
+
+func (l *domainLists) forwarder(name string) *downstream {
+	if len(l.forwarders) == 0 {
+		return nil
+	}
+	for name := normalize(name); name != ""; name = parentDomain(name) {
+		if d, ok := l.forwarders[name]; ok {
+			return d
+		}
+	}
+	return nil
+}
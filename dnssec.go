@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Root zone trust anchors (KSK-2017 and KSK-2024) as published by IANA.
+var rootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// How long to remember that a zone is not signed.
+const insecureZoneTTL = 5 * time.Minute
+
+var errBogus = errors.New("DNSSEC validation failed")
+
+type zoneKeys struct {
+	// nil if the zone is not signed.
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+// validator verifies DNSSEC signatures of downstream responses by building
+// the chain of trust from the trust anchors down to the signer of each RRset.
+//
+// Only positive answers can be proven secure. Denial of existence proofs
+// (NSEC, NSEC3) are checked only for missing DS records of zones in the chain,
+// so negative responses never get the AD bit.
+type validator struct {
+	// Sends a query to downstreams.
+	exchange func(*dns.Msg) (*dns.Msg, error)
+
+	anchors []*dns.DS
+
+	lock  sync.Mutex
+	zones map[string]zoneKeys
+}
+
+func newValidator(anchorsFile string, exchange func(*dns.Msg) (*dns.Msg, error)) (*validator, error) {
+	v := &validator{
+		exchange: exchange,
+		zones:    make(map[string]zoneKeys),
+	}
+
+	if anchorsFile == "" {
+		for _, s := range rootAnchors {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				panic(err)
+			}
+			v.anchors = append(v.anchors, rr.(*dns.DS))
+		}
+		return v, nil
+	}
+
+	f, err := os.Open(anchorsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", anchorsFile, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, fmt.Errorf("%s: trust anchor must be a DS record: %s", anchorsFile, line)
+		}
+		v.anchors = append(v.anchors, ds)
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	if len(v.anchors) == 0 {
+		return nil, fmt.Errorf("%s: no trust anchors", anchorsFile)
+	}
+	return v, nil
+}
+
+// validate checks signatures in the answer section of resp. secure is true
+// if all answer RRsets are signed and their signatures chain up to a trust
+// anchor. errBogus is returned if a signature is present but does not verify.
+func (v *validator) validate(resp *dns.Msg) (secure bool, err error) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+		return false, nil
+	}
+
+	type setKey struct {
+		name  string
+		rtype uint16
+	}
+	var order []setKey
+	sets := make(map[setKey][]dns.RR)
+	sigs := make(map[setKey][]*dns.RRSIG)
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k := setKey{strings.ToLower(hdr.Name), sig.TypeCovered}
+			sigs[k] = append(sigs[k], sig)
+			continue
+		}
+		k := setKey{strings.ToLower(hdr.Name), hdr.Rrtype}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+
+	secure = true
+	for _, k := range order {
+		setSecure, err := v.verifyRRset(sets[k], sigs[k])
+		if err != nil {
+			return false, err
+		}
+		if !setSecure {
+			secure = false
+		}
+	}
+	return secure, nil
+}
+
+// verifyRRset checks that at least one of sigs is a valid signature for
+// rrset made by a trusted key.
+func (v *validator) verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG) (bool, error) {
+	if len(sigs) == 0 {
+		return false, nil
+	}
+
+	owner := rrset[0].Header().Name
+	now := time.Now()
+	var lastErr error
+	checked := false
+	for _, sig := range sigs {
+		signer := strings.ToLower(sig.SignerName)
+		if !dns.IsSubDomain(signer, owner) {
+			continue
+		}
+		// DS records are signed by the parent zone.
+		if rrset[0].Header().Rrtype == dns.TypeDS && dns.CountLabel(signer) >= dns.CountLabel(owner) {
+			continue
+		}
+		// Wildcard expansion needs a proof that no closer match exists,
+		// which we do not check.
+		if int(sig.Labels) < dns.CountLabel(owner) {
+			continue
+		}
+
+		keys, err := v.keys(signer)
+		if err != nil {
+			return false, err
+		}
+		if keys == nil {
+			// Unsigned zone.
+			return false, nil
+		}
+
+		checked = true
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				lastErr = fmt.Errorf("%w: signature for %s %s expired or not yet valid", errBogus, owner, dns.TypeToString[sig.TypeCovered])
+				continue
+			}
+			if err := sig.Verify(key, rrset); err != nil {
+				lastErr = fmt.Errorf("%w: %s %s: %v", errBogus, owner, dns.TypeToString[sig.TypeCovered], err)
+				continue
+			}
+			return true, nil
+		}
+	}
+
+	if !checked {
+		return false, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("%w: no usable signature for %s %s", errBogus, owner, dns.TypeToString[rrset[0].Header().Rrtype])
+	}
+	return false, lastErr
+}
+
+// keys returns validated DNSKEYs of zone or nil if the zone is not signed.
+func (v *validator) keys(zone string) ([]*dns.DNSKEY, error) {
+	v.lock.Lock()
+	entry, ok := v.zones[zone]
+	v.lock.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.keys, nil
+	}
+
+	var dsSet []*dns.DS
+	if zone == "." {
+		dsSet = v.anchors
+	} else {
+		var err error
+		dsSet, err = v.fetchDS(zone)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(dsSet) == 0 {
+		v.store(zone, nil, time.Now().Add(insecureZoneTTL))
+		return nil, nil
+	}
+
+	resp, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		keys    []*dns.DNSKEY
+		keySet  []dns.RR
+		keySigs []*dns.RRSIG
+	)
+	for _, rr := range resp.Answer {
+		if !strings.EqualFold(rr.Header().Name, zone) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, rr)
+			keySet = append(keySet, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				keySigs = append(keySigs, rr)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no DNSKEY for %s", errBogus, zone)
+	}
+
+	// The DNSKEY RRset must be signed by a key matching one of the DS records.
+	now := time.Now()
+	for _, ksk := range keys {
+		if !matchesDS(ksk, dsSet) {
+			continue
+		}
+		for _, sig := range keySigs {
+			if sig.KeyTag != ksk.KeyTag() || sig.Algorithm != ksk.Algorithm || !sig.ValidityPeriod(now) {
+				continue
+			}
+			if err := sig.Verify(ksk, keySet); err != nil {
+				continue
+			}
+
+			expires := now.Add(time.Duration(keySet[0].Header().Ttl) * time.Second)
+			if sigExpires := time.Unix(int64(sig.Expiration), 0); sigExpires.Before(expires) {
+				expires = sigExpires
+			}
+			v.store(zone, keys, expires)
+			return keys, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: DNSKEY set of %s is not signed by a trusted key", errBogus, zone)
+}
+
+// fetchDS returns the validated DS RRset for zone. An empty set means the
+// zone is not signed or its parent is not. errBogus is returned if DS records
+// are present but do not verify, or if they are missing from a signed parent
+// without a validated NSEC or NSEC3 proof of their absence.
+func (v *validator) fetchDS(zone string) ([]*dns.DS, error) {
+	resp, err := v.query(zone, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		dsSet []*dns.DS
+		rrset []dns.RR
+		sigs  []*dns.RRSIG
+	)
+	for _, rr := range resp.Answer {
+		if !strings.EqualFold(rr.Header().Name, zone) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.DS:
+			dsSet = append(dsSet, rr)
+			rrset = append(rrset, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDS {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	if len(dsSet) == 0 {
+		return nil, v.checkNoDS(zone, resp)
+	}
+
+	secure, err := v.verifyRRset(rrset, sigs)
+	if err != nil {
+		return nil, err
+	}
+	if !secure {
+		// Signatures are missing or made by an unsigned zone.
+		parent, err := v.keys(parentZone(zone, resp.Answer))
+		if err != nil {
+			return nil, err
+		}
+		if parent != nil {
+			return nil, fmt.Errorf("%w: DS set of %s is not signed", errBogus, zone)
+		}
+		return nil, nil
+	}
+	return dsSet, nil
+}
+
+// checkNoDS checks resp, a response without DS records for zone, to prove
+// that the zone is not signed: either its parent is not signed or the
+// authority section has a validated NSEC or NSEC3 record showing there is no
+// DS RRset (including opt-out NSEC3 spans covering the zone).
+func (v *validator) checkNoDS(zone string, resp *dns.Msg) error {
+	parent := parentZone(zone, resp.Ns)
+	keys, err := v.keys(parent)
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return nil
+	}
+
+	type setKey struct {
+		name  string
+		rtype uint16
+	}
+	sets := make(map[setKey][]dns.RR)
+	sigs := make(map[setKey][]*dns.RRSIG)
+	for _, rr := range resp.Ns {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(parent, hdr.Name) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.NSEC, *dns.NSEC3:
+			k := setKey{strings.ToLower(hdr.Name), hdr.Rrtype}
+			sets[k] = append(sets[k], rr)
+		case *dns.RRSIG:
+			// Only the parent can deny DS records, this also keeps keys
+			// from recursing into zone.
+			if !strings.EqualFold(rr.SignerName, parent) {
+				continue
+			}
+			if rr.TypeCovered == dns.TypeNSEC || rr.TypeCovered == dns.TypeNSEC3 {
+				k := setKey{strings.ToLower(hdr.Name), rr.TypeCovered}
+				sigs[k] = append(sigs[k], rr)
+			}
+		}
+	}
+
+	var nsec3 []*dns.NSEC3
+	for k, set := range sets {
+		secure, err := v.verifyRRset(set, sigs[k])
+		if err != nil {
+			return err
+		}
+		if !secure {
+			continue
+		}
+		for _, rr := range set {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				if strings.EqualFold(rr.Hdr.Name, zone) && hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeDS) {
+					return nil
+				}
+			case *dns.NSEC3:
+				nsec3 = append(nsec3, rr)
+			}
+		}
+	}
+	if provesNoDS(zone, nsec3) {
+		return nil
+	}
+	return fmt.Errorf("%w: no proof that %s has no DS records", errBogus, zone)
+}
+
+// provesNoDS reports whether records prove that zone has no DS RRset: a
+// record matches it and does not list DS, or an opt-out record covers the
+// next closer name of its closest encloser (RFC 5155, section 8.6).
+func provesNoDS(zone string, records []*dns.NSEC3) bool {
+	for _, rr := range records {
+		if rr.Match(zone) {
+			return hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeDS)
+		}
+	}
+
+	nextCloser := zone
+	for off, end := dns.NextLabel(zone, 0); !end; off, end = dns.NextLabel(zone, off) {
+		encloser := zone[off:]
+		for _, ce := range records {
+			if !ce.Match(encloser) {
+				continue
+			}
+			for _, rr := range records {
+				if rr.Flags&1 == 1 && rr.Cover(nextCloser) {
+					return true
+				}
+			}
+			return false
+		}
+		nextCloser = encloser
+	}
+	return false
+}
+
+// parentZone returns the zone signing records in rrs, taken from their
+// signatures or the SOA record, if they show one above zone. Otherwise the
+// parent domain of zone is used.
+func parentZone(zone string, rrs []dns.RR) string {
+	for _, rr := range rrs {
+		var name string
+		switch rr := rr.(type) {
+		case *dns.RRSIG:
+			name = rr.SignerName
+		case *dns.SOA:
+			name = rr.Hdr.Name
+		default:
+			continue
+		}
+		name = strings.ToLower(name)
+		if dns.IsSubDomain(name, zone) && !strings.EqualFold(name, zone) {
+			return name
+		}
+	}
+	if off, end := dns.NextLabel(zone, 0); !end {
+		return strings.ToLower(zone[off:])
+	}
+	return "."
+}
+
+func hasType(bitmap []uint16, rtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rtype {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *validator) query(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	m.CheckingDisabled = true
+
+	resp, err := v.exchange(m)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", name, dns.TypeToString[qtype], err)
+	}
+	return resp, nil
+}
+
+func (v *validator) store(zone string, keys []*dns.DNSKEY, expires time.Time) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.zones[zone] = zoneKeys{keys: keys, expires: expires}
+}
+
+func matchesDS(key *dns.DNSKEY, dsSet []*dns.DS) bool {
+	for _, ds := range dsSet {
+		if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+			continue
+		}
+		computed := key.ToDS(ds.DigestType)
+		if computed != nil && strings.EqualFold(computed.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateReply sets the AD bit on resp if the local validator could verify
+// it. A SERVFAIL response is returned instead if signatures are invalid.
+func (s *Server) validateReply(req, resp *dns.Msg) *dns.Msg {
+	opt := req.IsEdns0()
+	if opt == nil || !opt.Do() || req.CheckingDisabled || resp.AuthenticatedData {
+		return resp
+	}
+
+	secure, err := s.validator.validate(resp)
+	if err != nil {
+		log.Printf("DNSSEC validation of %s: %v", req.Question[0].Name, err)
+		if errors.Is(err, errBogus) {
+			reply := new(dns.Msg)
+			reply.SetRcode(req, dns.RcodeServerFailure)
+			reply.RecursionAvailable = s.recursion
+			return reply
+		}
+		return resp
+	}
+	resp.AuthenticatedData = secure
+	return resp
+}
+
+// stripDNSSEC removes DNSSEC records from resp, except for ones of the queried
+// type (e.g. DNSKEY records in the response to a DNSKEY query).
+func stripDNSSEC(resp *dns.Msg) {
+	qtype := uint16(0)
+	if len(resp.Question) != 0 {
+		qtype = resp.Question[0].Qtype
+	}
+	strip := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeDNSKEY, dns.TypeDS:
+				if t != qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	resp.Answer = strip(resp.Answer)
+	resp.Ns = strip(resp.Ns)
+	resp.Extra = strip(resp.Extra)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is a signed zone with a single key used for all records.
+type testZone struct {
+	t    *testing.T
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	t.Helper()
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{t: t, key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns rrset followed by its signature.
+func (z *testZone) sign(rrset ...dns.RR) []dns.RR {
+	z.t.Helper()
+
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Algorithm:  z.key.Algorithm,
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		z.t.Fatal(err)
+	}
+	return append(rrset, sig)
+}
+
+func (z *testZone) ds() *dns.DS {
+	return z.key.ToDS(dns.SHA256)
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestFetchDS(t *testing.T) {
+	root := newTestZone(t, ".")
+	tld := newTestZone(t, "example.")
+	child := newTestZone(t, "child.example.")
+
+	soa := testRR(t, "example. 3600 IN SOA ns.example. hostmaster.example. 1 900 900 1800 60")
+	nsec := func(types string) dns.RR {
+		return testRR(t, "child.example. 3600 IN NSEC z.example. "+types)
+	}
+	// Matches name only.
+	nsec3 := func(name, types string) dns.RR {
+		hash := dns.HashName(name, dns.SHA1, 0, "")
+		return testRR(t, strings.ToLower(hash)+".example. 3600 IN NSEC3 1 0 0 - "+hash+" "+types)
+	}
+	// Covers all names.
+	const (
+		first = "00000000000000000000000000000000"
+		last  = "VVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVV"
+	)
+	optOutSpan := func(optOut bool) dns.RR {
+		flags := "0"
+		if optOut {
+			flags = "1"
+		}
+		return testRR(t, strings.ToLower(first)+".example. 3600 IN NSEC3 1 "+flags+" 0 - "+last+" A")
+	}
+	childDS := child.ds()
+	childDS.Hdr = dns.RR_Header{Name: "child.example.", Rrtype: dns.TypeDS, Class: dns.ClassINET, Ttl: 3600}
+	forged := dns.Copy(childDS).(*dns.DS)
+	forged.Digest = strings.Repeat("00", 32)
+	badSig := tld.sign(childDS)
+	badSig[0] = forged
+
+	cases := []struct {
+		name   string
+		answer []dns.RR
+		ns     []dns.RR
+		ds     bool
+		bogus  bool
+	}{
+		{name: "signed DS", answer: tld.sign(childDS), ds: true},
+		{name: "unsigned DS", answer: []dns.RR{childDS}, bogus: true},
+		{name: "forged DS", answer: badSig, bogus: true},
+		{name: "DS signed by the child", answer: child.sign(childDS), bogus: true},
+		{name: "no proof", ns: tld.sign(soa), bogus: true},
+		{name: "no records", bogus: true},
+		{name: "NSEC", ns: append(tld.sign(soa), tld.sign(nsec("NS RRSIG NSEC"))...)},
+		{name: "NSEC with DS", ns: append(tld.sign(soa), tld.sign(nsec("NS DS RRSIG NSEC"))...), bogus: true},
+		{name: "NSEC without NS", ns: append(tld.sign(soa), tld.sign(nsec("A RRSIG NSEC"))...), bogus: true},
+		{name: "unsigned NSEC", ns: append(tld.sign(soa), nsec("NS RRSIG NSEC")), bogus: true},
+		{name: "NSEC signed by the child", ns: append(tld.sign(soa), child.sign(nsec("NS RRSIG NSEC"))...), bogus: true},
+		{name: "NSEC3", ns: append(tld.sign(soa), tld.sign(nsec3("child.example.", "NS"))...)},
+		{name: "NSEC3 with DS", ns: append(tld.sign(soa), tld.sign(nsec3("child.example.", "NS DS"))...), bogus: true},
+		{name: "NSEC3 opt-out", ns: append(append(tld.sign(soa),
+			tld.sign(nsec3("example.", "NS SOA DNSKEY"))...),
+			tld.sign(optOutSpan(true))...)},
+		{name: "NSEC3 without opt-out", ns: append(append(tld.sign(soa),
+			tld.sign(nsec3("example.", "NS SOA DNSKEY"))...),
+			tld.sign(optOutSpan(false))...), bogus: true},
+		{name: "NSEC3 opt-out without closest encloser", ns: append(tld.sign(soa), tld.sign(optOutSpan(true))...), bogus: true},
+	}
+	for _, c := range cases {
+		tldDS := tld.ds()
+		tldDS.Hdr = dns.RR_Header{Name: "example.", Rrtype: dns.TypeDS, Class: dns.ClassINET, Ttl: 3600}
+		exchange := func(m *dns.Msg) (*dns.Msg, error) {
+			q := m.Question[0]
+			reply := new(dns.Msg)
+			reply.SetReply(m)
+			switch {
+			case q.Name == "." && q.Qtype == dns.TypeDNSKEY:
+				reply.Answer = root.sign(root.key)
+			case q.Name == "example." && q.Qtype == dns.TypeDS:
+				reply.Answer = root.sign(tldDS)
+			case q.Name == "example." && q.Qtype == dns.TypeDNSKEY:
+				reply.Answer = tld.sign(tld.key)
+			case q.Name == "child.example." && q.Qtype == dns.TypeDS:
+				reply.Answer = c.answer
+				reply.Ns = c.ns
+			default:
+				reply.Rcode = dns.RcodeRefused
+			}
+			return reply, nil
+		}
+		v := &validator{
+			exchange: exchange,
+			anchors:  []*dns.DS{root.ds()},
+			zones:    make(map[string]zoneKeys),
+		}
+
+		dsSet, err := v.fetchDS("child.example.")
+		if c.bogus {
+			if !errors.Is(err, errBogus) {
+				t.Errorf("%s: error is %v, expected errBogus", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if c.ds && len(dsSet) != 1 {
+			t.Errorf("%s: %d DS records, expected 1", c.name, len(dsSet))
+		}
+		if !c.ds && len(dsSet) != 0 {
+			t.Errorf("%s: %d DS records, expected none", c.name, len(dsSet))
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+const dohContentType = "application/dns-message"
+
+// dohWriter is the dns.ResponseWriter for queries received using
+// DNS-over-HTTPS or DNSCrypt, it keeps the response to send it in the HTTP
+// response or encrypt it.
+type dohWriter struct {
+	local  net.Addr
+	remote net.Addr
+	resp   *dns.Msg
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	w.resp = m
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.resp = m
+	return len(b), nil
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
+
+func tcpAddr(hostPort string) net.Addr {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	portNum, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: portNum}
+}
+
+// serveDoH handles RFC 8484 DNS-over-HTTPS requests using both GET and POST
+// methods. Queries are processed by ServeDNS like ones received over UDP or
+// TCP.
+func (s *Server) serveDoH(w http.ResponseWriter, r *http.Request) {
+	var wire []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(wire) == 0 {
+			http.Error(w, "malformed dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		wire, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(wire); err != nil {
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	dw := &dohWriter{
+		local:  tcpAddr(r.Host),
+		remote: tcpAddr(r.RemoteAddr),
+	}
+	s.ServeDNS(dw, req)
+	if dw.resp == nil {
+		// Dropped, e.g. due to the rate limit.
+		http.Error(w, "query dropped", http.StatusServiceUnavailable)
+		return
+	}
+
+	out, err := dw.resp.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := minTTL(dw.resp); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(out)
+}
+
+// minTTL returns the minimum TTL of records in the answer and authority
+// sections of m, as RFC 8484 suggests for HTTP freshness lifetime. For SOA
+// records, the negative caching TTL from RFC 2308 is used. ok is false if
+// there are no such records.
+func minTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			rrTTL := rr.Header().Ttl
+			if soa, isSOA := rr.(*dns.SOA); isSOA && soa.Minttl < rrTTL {
+				rrTTL = soa.Minttl
+			}
+			if !ok || rrTTL < ttl {
+				ttl = rrTTL
+				ok = true
+			}
+		}
+	}
+	return ttl, ok
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type downstream struct {
+	// Set to 1 by the health checker if the downstream does not respond.
+	down uint32
+	// Health check scheduling, see healthCheckLoop.
+	probe probeBackoff
+	// Used if circuit_breaker_error_percent is set.
+	breaker circuitBreaker
+
+	queries uint32
+	errors  uint32
+	rtt     *rttWindow
+	// Failed exchanges by kind, see errorKind.
+	refused     uint32
+	unreachable uint32
+	timeouts    uint32
+
+	// Share of queries relative to other downstreams, at least 1.
+	weight int
+
+	// Entry as written in the configuration, used in logs.
+	name string
+	addr string
+	// Whether the channel is authenticated and flags from responses can be
+	// trusted.
+	secure bool
+
+	cl *dns.Client
+	// Used to retry truncated UDP responses, nil for other transports.
+	tcpCl *dns.Client
+	// Set for DNS-over-HTTPS downstreams, addr is the URL then.
+	doh *http.Client
+}
+
+// downstreamTimeouts limit phases of an exchange with a downstream.
+type downstreamTimeouts struct {
+	dial  time.Duration
+	read  time.Duration
+	write time.Duration
+}
+
+func configTimeouts(cfg Config) downstreamTimeouts {
+	return downstreamTimeouts{
+		dial:  time.Duration(cfg.DialTimeoutSecs) * time.Second,
+		read:  time.Duration(cfg.ReadTimeoutSecs) * time.Second,
+		write: time.Duration(cfg.WriteTimeoutSecs) * time.Second,
+	}
+}
+
+func (t downstreamTimeouts) client(network string) *dns.Client {
+	return &dns.Client{
+		Net:          network,
+		DialTimeout:  t.dial,
+		ReadTimeout:  t.read,
+		WriteTimeout: t.write,
+	}
+}
+
+// parseDownstream parses the downstream entry from the configuration.
+//
+// Plain entries are IP addresses of resolvers on port 53. For DNS-over-TLS,
+// use tls://host[:port][#server name], port defaults to 853 and server name
+// used for certificate verification defaults to host. DNS-over-HTTPS
+// downstreams are specified using the full https:// URL.
+//
+// network is the transport used for plain entries: udp (with TCP fallback for
+// truncated responses), tcp or tcp-tls (port 853, the certificate must be
+// valid for the IP address).
+func parseDownstream(entry, network string, timeouts downstreamTimeouts) (*downstream, error) {
+	d := &downstream{name: entry, rtt: newRTTWindow()}
+
+	if strings.HasPrefix(entry, "https://") {
+		if _, err := url.Parse(entry); err != nil {
+			return nil, fmt.Errorf("downstream %s: %w", entry, err)
+		}
+		d.addr = entry
+		d.secure = true
+		// Phases of HTTP requests are not limited separately.
+		d.doh = &http.Client{
+			Timeout: timeouts.dial + timeouts.write + timeouts.read,
+		}
+		return d, nil
+	}
+
+	if strings.HasPrefix(entry, "tls://") {
+		hostPort := strings.TrimPrefix(entry, "tls://")
+		serverName := ""
+		if indx := strings.Index(hostPort, "#"); indx != -1 {
+			serverName = hostPort[indx+1:]
+			hostPort = hostPort[:indx]
+		}
+
+		host, port, err := splitDownstreamAddr(hostPort, "853")
+		if err != nil {
+			return nil, fmt.Errorf("downstream %s: %w", entry, err)
+		}
+		if host == "" {
+			return nil, fmt.Errorf("downstream %s: missing host", entry)
+		}
+		if serverName == "" {
+			serverName = host
+		}
+
+		d.addr = net.JoinHostPort(host, port)
+		d.secure = true
+		d.cl = timeouts.client("tcp-tls")
+		d.cl.TLSConfig = &tls.Config{
+			ServerName: serverName,
+		}
+		return d, nil
+	}
+
+	if strings.Contains(entry, "://") {
+		return nil, fmt.Errorf("downstream %s: unsupported scheme", entry)
+	}
+
+	switch network {
+	case "udp", "tcp":
+		host, port, err := splitDownstreamAddr(entry, "53")
+		if err != nil {
+			return nil, fmt.Errorf("downstream %s: %w", entry, err)
+		}
+		d.addr = net.JoinHostPort(host, port)
+		d.secure = isLoopback(host)
+		d.cl = timeouts.client(network)
+		if network == "udp" {
+			d.tcpCl = timeouts.client("tcp")
+		}
+	case "tcp-tls":
+		d, err := parseDownstream("tls://"+entry, network, timeouts)
+		if err != nil {
+			return nil, err
+		}
+		d.name = entry
+		return d, nil
+	default:
+		return nil, fmt.Errorf("unknown downstream_net: %s", network)
+	}
+	return d, nil
+}
+
+// splitDownstreamAddr splits the address of a downstream (without the scheme)
+// into host and port, defaultPort is used if addr has none, e.g. 127.0.0.1 or
+// 127.0.0.1:5335. IPv6 addresses can be written as is (2001:db8::1), with a
+// zone (fe80::1%eth0) or in brackets, which is required to specify the port:
+// [2001:db8::1]:5353.
+func splitDownstreamAddr(addr, defaultPort string) (host, port string, err error) {
+	switch {
+	case strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]"):
+		return addr[1 : len(addr)-1], defaultPort, nil
+	case !strings.HasPrefix(addr, "[") && strings.Count(addr, ":") != 1:
+		// No port or an IPv6 address without brackets.
+		return addr, defaultPort, nil
+	}
+	host, port, err = net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", "", fmt.Errorf("invalid port: %s", port)
+	}
+	return host, port, nil
+}
+
+// splitZone parses an IP address with an optional IPv6 zone (fe80::1%eth0),
+// ip is nil if addr is not an IP address.
+func splitZone(addr string) (ip net.IP, zone string) {
+	if indx := strings.LastIndexByte(addr, '%'); indx != -1 {
+		addr, zone = addr[:indx], addr[indx+1:]
+	}
+	return net.ParseIP(addr), zone
+}
+
+// splitWeight splits the weight=N option from the downstream entry. weight is
+// 1 if the option is not present.
+func splitWeight(entry string) (string, int, error) {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return "", 0, fmt.Errorf("empty downstream entry")
+	}
+
+	weight := 1
+	for _, opt := range fields[1:] {
+		if !strings.HasPrefix(opt, "weight=") {
+			return "", 0, fmt.Errorf("downstream %s: unknown option: %s", entry, opt)
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(opt, "weight="))
+		if err != nil || n < 1 {
+			return "", 0, fmt.Errorf("downstream %s: weight must be a positive integer", entry)
+		}
+		weight = n
+	}
+	return fields[0], weight, nil
+}
+
+// weightedSchedule returns the order in which downstreams are used, as
+// indexes into downstreams. Each downstream appears weight times and
+// appearances are spread evenly using the smooth weighted round-robin
+// algorithm, so a heavy downstream does not get all its queries in a row.
+func weightedSchedule(downstreams []*downstream) []int {
+	total := 0
+	for _, d := range downstreams {
+		total += d.weight
+	}
+
+	schedule := make([]int, 0, total)
+	current := make([]int, len(downstreams))
+	for len(schedule) < total {
+		best := 0
+		for i, d := range downstreams {
+			current[i] += d.weight
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
+
+// transport names the protocol used for the downstream, for logs.
+func (d *downstream) transport() string {
+	if d.doh != nil {
+		return "https"
+	}
+	if d.cl.Net == "tcp-tls" {
+		return "tls"
+	}
+	return d.cl.Net
+}
+
+var errBadResponse = errors.New("response does not match the query")
+
+// exchange sends msg to the downstream. Responses that do not match msg
+// (see checkResponse) are returned as errors.
+func (d *downstream) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	resp, err := d.roundTrip(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(msg, resp); err != nil {
+		return nil, fmt.Errorf("%s: %w", d.name, err)
+	}
+	return resp, nil
+}
+
+// roundTrip sends msg to the downstream and waits for the response.
+//
+// ctx cancellation is honored only for DNS-over-HTTPS, other exchanges are
+// bounded by the client timeout or the ctx deadline, whichever is closer.
+func (d *downstream) roundTrip(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if d.doh != nil {
+		return d.exchangeDoH(ctx, msg)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	resp, _, err := withDeadline(ctx, d.cl).Exchange(msg, d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated && d.tcpCl != nil {
+		resp, _, err = withDeadline(ctx, d.tcpCl).Exchange(msg, d.addr)
+	}
+	return resp, err
+}
+
+// checkResponse verifies that resp is a response to msg: it has the same ID
+// and echoes the question. Mismatching responses come from broken resolvers
+// or off-path spoofing attempts.
+func checkResponse(msg, resp *dns.Msg) error {
+	if !resp.Response {
+		return fmt.Errorf("%w: QR bit is not set", errBadResponse)
+	}
+	if resp.Id != msg.Id {
+		return fmt.Errorf("%w: ID %d, expected %d", errBadResponse, resp.Id, msg.Id)
+	}
+	// Error responses to queries the server could not parse may omit it.
+	if len(resp.Question) == 0 && resp.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	if len(resp.Question) != len(msg.Question) {
+		return fmt.Errorf("%w: %d questions, expected %d", errBadResponse, len(resp.Question), len(msg.Question))
+	}
+	for i, q := range resp.Question {
+		want := msg.Question[i]
+		if q.Qtype != want.Qtype || q.Qclass != want.Qclass || !strings.EqualFold(q.Name, want.Name) {
+			return fmt.Errorf("%w: question %s %s, expected %s %s", errBadResponse,
+				q.Name, dns.TypeToString[q.Qtype], want.Name, dns.TypeToString[want.Qtype])
+		}
+	}
+	return nil
+}
+
+// withDeadline returns cl or, if the ctx deadline is closer than any of cl
+// timeouts, a copy of it with the timeouts reduced accordingly.
+func withDeadline(ctx context.Context, cl *dns.Client) *dns.Client {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return cl
+	}
+	remaining := time.Until(deadline)
+	if remaining >= cl.DialTimeout && remaining >= cl.ReadTimeout && remaining >= cl.WriteTimeout {
+		return cl
+	}
+	return &dns.Client{
+		Net:          cl.Net,
+		TLSConfig:    cl.TLSConfig,
+		DialTimeout:  minDuration(cl.DialTimeout, remaining),
+		ReadTimeout:  minDuration(cl.ReadTimeout, remaining),
+		WriteTimeout: minDuration(cl.WriteTimeout, remaining),
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// exchangeDoH sends msg using the RFC 8484 POST method.
+func (d *downstream) exchangeDoH(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	wire, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// RFC 8484 recommends using ID 0 to make responses HTTP cache-friendly.
+	wire[0], wire[1] = 0, 0
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.addr, bytes.NewReader(wire))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	httpResp, err := d.doh.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", httpResp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	resp.Id = msg.Id
+	return resp, nil
+}
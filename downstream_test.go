@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var testTimeouts = downstreamTimeouts{dial: time.Second, read: time.Second, write: time.Second}
+
+// startStub starts a DNS server on a random loopback port serving both UDP
+// and TCP using handler and returns its address.
+func startStub(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+
+	for _, srv := range []*dns.Server{
+		{PacketConn: pc, Handler: handler},
+		{Listener: l, Handler: handler},
+	} {
+		srv := srv
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { srv.Shutdown() })
+	}
+	return pc.LocalAddr().String()
+}
+
+// isTCP reports whether the stub got the query over TCP.
+func isTCP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.TCPAddr)
+	return ok
+}
+
+func testAnswer(q dns.Question, ip string) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP(ip),
+	}
+}
+
+// truncatingStub answers over UDP with the TC bit set and no records, over
+// TCP with n A records.
+func truncatingStub(n int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, m *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(m)
+		if !isTCP(w) {
+			reply.Truncated = true
+		} else {
+			for i := 0; i < n; i++ {
+				reply.Answer = append(reply.Answer, testAnswer(m.Question[0], net.IPv4(10, 0, 0, byte(i+1)).String()))
+			}
+		}
+		w.WriteMsg(reply)
+	}
+}
+
+func TestExchangeTruncatedFallback(t *testing.T) {
+	addr := startStub(t, truncatingStub(3))
+
+	cases := []struct {
+		network   string
+		truncated bool
+		answers   int
+	}{
+		// Retried over TCP.
+		{"udp", false, 3},
+		{"tcp", false, 3},
+	}
+	for _, c := range cases {
+		d, err := parseDownstream(addr, c.network, testTimeouts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := new(dns.Msg)
+		msg.SetQuestion("big.example.org.", dns.TypeA)
+		resp, err := d.exchange(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("%s: %v", c.network, err)
+		}
+		if resp.Truncated != c.truncated {
+			t.Errorf("%s: TC is %v, expected %v", c.network, resp.Truncated, c.truncated)
+		}
+		if len(resp.Answer) != c.answers {
+			t.Errorf("%s: %d answers, expected %d", c.network, len(resp.Answer), c.answers)
+		}
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeA)
+
+	cases := []struct {
+		name   string
+		modify func(resp *dns.Msg)
+		ok     bool
+	}{
+		{"matching", func(resp *dns.Msg) {}, true},
+		{"name case", func(resp *dns.Msg) { resp.Question[0].Name = "EXAMPLE.org." }, true},
+		{"no QR", func(resp *dns.Msg) { resp.Response = false }, false},
+		{"ID", func(resp *dns.Msg) { resp.Id = msg.Id + 1 }, false},
+		{"name", func(resp *dns.Msg) { resp.Question[0].Name = "example.net." }, false},
+		{"type", func(resp *dns.Msg) { resp.Question[0].Qtype = dns.TypeAAAA }, false},
+		{"class", func(resp *dns.Msg) { resp.Question[0].Qclass = dns.ClassCHAOS }, false},
+		{"no question", func(resp *dns.Msg) { resp.Question = nil }, false},
+		{"no question in error", func(resp *dns.Msg) {
+			resp.Question = nil
+			resp.Rcode = dns.RcodeFormatError
+		}, true},
+		{"two questions", func(resp *dns.Msg) { resp.Question = append(resp.Question, resp.Question[0]) }, false},
+	}
+	for _, c := range cases {
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		c.modify(resp)
+		err := checkResponse(msg, resp)
+		if c.ok && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !c.ok && !errors.Is(err, errBadResponse) {
+			t.Errorf("%s: error is %v, expected errBadResponse", c.name, err)
+		}
+	}
+}
+
+func TestExchangeBadResponse(t *testing.T) {
+	addr := startStub(t, func(w dns.ResponseWriter, m *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(m)
+		reply.Question[0].Name = "spoofed.example.org."
+		reply.Answer = []dns.RR{testAnswer(reply.Question[0], "192.0.2.1")}
+		w.WriteMsg(reply)
+	})
+
+	for _, network := range []string{"udp", "tcp"} {
+		d, err := parseDownstream(addr, network, testTimeouts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", dns.TypeA)
+		if _, err := d.exchange(context.Background(), msg); !errors.Is(err, errBadResponse) {
+			t.Errorf("%s: error is %v, expected errBadResponse", network, err)
+		}
+	}
+}
+
+func TestParseDownstreamIPv6(t *testing.T) {
+	cases := []struct {
+		entry   string
+		network string
+		addr    string
+	}{
+		{"192.0.2.1", "udp", "192.0.2.1:53"},
+		{"192.0.2.1:5353", "udp", "192.0.2.1:5353"},
+		{"2001:db8::1", "udp", "[2001:db8::1]:53"},
+		{"[2001:db8::1]", "udp", "[2001:db8::1]:53"},
+		{"[2001:db8::1]:5353", "udp", "[2001:db8::1]:5353"},
+		{"fe80::1%eth0", "udp", "[fe80::1%eth0]:53"},
+		{"[fe80::1%eth0]:5353", "tcp", "[fe80::1%eth0]:5353"},
+		{"::1", "tcp", "[::1]:53"},
+		{"tls://2001:db8::1", "udp", "[2001:db8::1]:853"},
+		{"tls://[2001:db8::1]:8853#dns.example.org", "udp", "[2001:db8::1]:8853"},
+		{"2001:db8::1", "tcp-tls", "[2001:db8::1]:853"},
+	}
+	for _, c := range cases {
+		d, err := parseDownstream(c.entry, c.network, testTimeouts)
+		if err != nil {
+			t.Errorf("%s: %v", c.entry, err)
+			continue
+		}
+		if d.addr != c.addr {
+			t.Errorf("%s: address is %s, expected %s", c.entry, d.addr, c.addr)
+		}
+	}
+
+	for _, entry := range []string{"[2001:db8::1]:0", "[2001:db8::1]:dns", "[2001:db8::1", "tls://:853"} {
+		if _, err := parseDownstream(entry, "udp", testTimeouts); err == nil {
+			t.Errorf("%s: no error", entry)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// effectiveEntries returns sorted entries of l that are actually blocked:
+// blacklisted domains (including ones from categories not disabled) that do
+// not match the whitelist, followed by *.wildcard and /pattern/ entries.
+func (l *domainLists) effectiveEntries(disabled map[string]bool) []string {
+	sets := []*domainSet{l.black}
+	for _, c := range l.categories {
+		if !disabled[c.name] {
+			sets = append(sets, c.black)
+		}
+	}
+
+	seen := make(map[string]struct{})
+	var domains, rules []string
+	add := func(list *[]string, entry string) {
+		if _, ok := seen[entry]; ok {
+			return
+		}
+		seen[entry] = struct{}{}
+		*list = append(*list, entry)
+	}
+	for _, set := range sets {
+		for domain := range set.domains {
+			if _, white := l.white.match(domain, false); !white {
+				add(&domains, domain)
+			}
+		}
+		for domain := range set.wildcards {
+			add(&rules, "*."+domain)
+		}
+		for _, re := range set.regexps {
+			add(&rules, "/"+re.String()+"/")
+		}
+	}
+	sort.Strings(domains)
+	sort.Strings(rules)
+	return append(domains, rules...)
+}
+
+// dumpEffectiveList writes effectiveEntries of l to path, one per line. The
+// file is replaced atomically, so it can be diffed while rhole reloads lists.
+func dumpEffectiveList(path string, l *domainLists, disabled map[string]bool) (int, error) {
+	entries := l.effectiveEntries(disabled)
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".rhole-effective")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	for _, entry := range entries {
+		w.WriteString(entry)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return len(entries), os.Rename(f.Name(), path)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ecsStrip      = "strip"
+	ecsForward    = "forward"
+	ecsSynthesize = "synthesize"
+)
+
+func checkECSMode(mode string) error {
+	switch mode {
+	case ecsStrip, ecsForward, ecsSynthesize:
+		return nil
+	default:
+		return fmt.Errorf("unknown ecs_mode: %s", mode)
+	}
+}
+
+// withoutECS returns opt options except for EDNS Client Subnet.
+func withoutECS(opt *dns.OPT) []dns.EDNS0 {
+	options := make([]dns.EDNS0, 0, len(opt.Option))
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	return options
+}
+
+// ecsQuery returns the query to send to downstreams for m from client with
+// the EDNS Client Subnet option (RFC 7871) set according to the ECS mode,
+// along with the subnet it contains (empty if none). m is copied if it needs
+// changes, it is still used to build the reply to the client.
+func (s *Server) ecsQuery(m *dns.Msg, client net.IP) (*dns.Msg, string) {
+	opt := m.IsEdns0()
+
+	switch s.ecsMode {
+	case ecsForward:
+		if opt == nil {
+			return m, ""
+		}
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				return m, fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask)
+			}
+		}
+		return m, ""
+	case ecsSynthesize:
+		if client == nil {
+			break
+		}
+		subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+		if ip4 := client.To4(); ip4 != nil {
+			subnet.Family = 1
+			subnet.SourceNetmask = s.ecsPrefixV4
+			subnet.Address = ip4.Mask(net.CIDRMask(int(s.ecsPrefixV4), 8*net.IPv4len))
+		} else {
+			subnet.Family = 2
+			subnet.SourceNetmask = s.ecsPrefixV6
+			subnet.Address = client.Mask(net.CIDRMask(int(s.ecsPrefixV6), 8*net.IPv6len))
+		}
+
+		out := m.Copy()
+		outOpt := out.IsEdns0()
+		if outOpt == nil {
+			out.SetEdns0(s.ednsUDPSize, false)
+			outOpt = out.IsEdns0()
+		}
+		outOpt.Option = append(withoutECS(outOpt), subnet)
+		return out, fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask)
+	}
+
+	if opt == nil || len(withoutECS(opt)) == len(opt.Option) {
+		return m, ""
+	}
+	out := m.Copy()
+	outOpt := out.IsEdns0()
+	outOpt.Option = withoutECS(outOpt)
+	return out, ""
+}
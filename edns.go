@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// setEDNS replaces the OPT record in reply with one matching the EDNS0 OPT of
+// req and advertising udpSize as our buffer size. Replies to queries without
+// EDNS0 get no OPT record at all, as required by RFC 6891.
+func setEDNS(req, reply *dns.Msg, udpSize uint16) {
+	extra := make([]dns.RR, 0, len(reply.Extra))
+	for _, rr := range reply.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	reply.Extra = extra
+
+	opt := req.IsEdns0()
+	if opt == nil {
+		return
+	}
+	reply.SetEdns0(udpSize, opt.Do())
+}
+
+// udpLimit returns the maximum size of a UDP response to req: the buffer size
+// the client advertised in EDNS0 (512 bytes without EDNS0) but no more than
+// maxSize.
+func udpLimit(req *dns.Msg, maxSize int) int {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > maxSize {
+		size = maxSize
+	}
+	return size
+}
+
+// ednsWriter applies setEDNS to all responses written to the client and
+// truncates UDP responses to udpLimit, setting the TC bit so the client
+// retries over TCP.
+type ednsWriter struct {
+	dns.ResponseWriter
+	req     *dns.Msg
+	udpSize uint16
+	maxUDP  int
+}
+
+func (w *ednsWriter) WriteMsg(m *dns.Msg) error {
+	setEDNS(w.req, m, w.udpSize)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		m.Truncate(udpLimit(w.req, w.maxUDP))
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
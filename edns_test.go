@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// answeringStub answers A queries with 192.0.2.1, adding an OPT record with a
+// 4096 bytes buffer to replies to EDNS0 queries.
+func answeringStub(w dns.ResponseWriter, m *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	if m.Question[0].Qtype == dns.TypeA {
+		reply.Answer = []dns.RR{testAnswer(m.Question[0], "192.0.2.1")}
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		reply.SetEdns0(4096, opt.Do())
+	}
+	w.WriteMsg(reply)
+}
+
+func TestServeDNSEDNS(t *testing.T) {
+	addr := startStub(t, answeringStub)
+	s := newTestServer(t, `downstreams = ["`+addr+`"]
+blacklists = ["$DIR/bl.txt"]`, map[string]string{"bl.txt": "blocked.example.org\n"})
+
+	cases := []struct {
+		name  string
+		edns  bool
+		do    bool
+		rcode int
+	}{
+		{"blocked.example.org.", false, false, dns.RcodeNameError},
+		{"blocked.example.org.", true, false, dns.RcodeNameError},
+		{"blocked.example.org.", true, true, dns.RcodeNameError},
+		{"allowed.example.org.", false, false, dns.RcodeSuccess},
+		{"allowed.example.org.", true, false, dns.RcodeSuccess},
+		{"allowed.example.org.", true, true, dns.RcodeSuccess},
+	}
+	for _, c := range cases {
+		m := new(dns.Msg)
+		m.SetQuestion(c.name, dns.TypeA)
+		if c.edns {
+			m.SetEdns0(4096, c.do)
+		}
+		reply := serve(s, "udp", m)
+		if reply == nil {
+			t.Fatalf("%s: no reply", c.name)
+		}
+		if reply.Rcode != c.rcode {
+			t.Errorf("%s: rcode %s, expected %s", c.name, dns.RcodeToString[reply.Rcode], dns.RcodeToString[c.rcode])
+		}
+
+		opts := 0
+		for _, rr := range reply.Extra {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				opts++
+			}
+		}
+		opt := reply.IsEdns0()
+		switch {
+		case !c.edns && opts != 0:
+			t.Errorf("%s: reply to a query without EDNS0 has OPT", c.name)
+		case c.edns && opts != 1:
+			t.Errorf("%s: reply has %d OPT records, expected 1", c.name, opts)
+		case c.edns && opt.UDPSize() != 1232:
+			t.Errorf("%s: reply advertises %d bytes, expected 1232", c.name, opt.UDPSize())
+		case c.edns && opt.Do() != c.do:
+			t.Errorf("%s: DO is %v, expected %v", c.name, opt.Do(), c.do)
+		}
+	}
+}
+
+func TestServeDNSTruncateSynthesized(t *testing.T) {
+	addrs := make([]string, 0, 200)
+	for i := 0; i < cap(addrs); i++ {
+		addrs = append(addrs, fmt.Sprintf(`"10.0.%d.%d"`, i/256, i%256))
+	}
+	// The downstream is never contacted.
+	s := newTestServer(t, `downstreams = ["192.0.2.53"]
+
+[local_records]
+"big.lan" = [`+strings.Join(addrs, ", ")+`]`, nil)
+
+	cases := []struct {
+		network string
+		udpSize uint16 // 0 for no EDNS0
+		limit   int
+	}{
+		{"udp", 0, 512},
+		{"udp", 1000, 1000},
+		{"udp", 4096, 1232},
+		{"tcp", 0, dns.MaxMsgSize},
+		{"tcp", 4096, dns.MaxMsgSize},
+	}
+	for _, c := range cases {
+		m := new(dns.Msg)
+		m.SetQuestion("big.lan.", dns.TypeA)
+		if c.udpSize != 0 {
+			m.SetEdns0(c.udpSize, false)
+		}
+		reply := serve(s, c.network, m)
+		if reply == nil {
+			t.Fatalf("%s %d: no reply", c.network, c.udpSize)
+		}
+		packed, err := reply.Pack()
+		if err != nil {
+			t.Fatalf("%s %d: %v", c.network, c.udpSize, err)
+		}
+
+		truncated := c.network == "udp"
+		if reply.Truncated != truncated {
+			t.Errorf("%s %d: TC is %v, expected %v", c.network, c.udpSize, reply.Truncated, truncated)
+		}
+		if len(packed) > c.limit {
+			t.Errorf("%s %d: reply is %d bytes, expected at most %d", c.network, c.udpSize, len(packed), c.limit)
+		}
+		if !truncated && len(reply.Answer) != len(addrs) {
+			t.Errorf("%s %d: %d answers, expected %d", c.network, c.udpSize, len(reply.Answer), len(addrs))
+		}
+		if (c.udpSize != 0) != (reply.IsEdns0() != nil) {
+			t.Errorf("%s %d: OPT present is %v", c.network, c.udpSize, reply.IsEdns0() != nil)
+		}
+	}
+}
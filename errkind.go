@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// Kinds of failed downstream exchanges, see errorKind.
+const (
+	errKindRefused     = "refused"
+	errKindUnreachable = "unreachable"
+	errKindTimeout     = "timeout"
+	errKindOther       = "other"
+)
+
+// errorKind classifies the error of a downstream exchange. Refused
+// connections (or ICMP port unreachable for UDP) and unreachable networks
+// mean the downstream is hard down, timeouts usually mean it is slow or
+// overloaded.
+func errorKind(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errKindRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return errKindUnreachable
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return errKindTimeout
+	}
+	return errKindOther
+}
+
+// isHardDown reports whether err means that the downstream cannot be reached
+// at all, so there is no point in waiting for it or retrying it.
+func isHardDown(err error) bool {
+	kind := errorKind(err)
+	return kind == errKindRefused || kind == errKindUnreachable
+}
+
+// countError updates error counters of d for the failed exchange. If health
+// checks are enabled, a hard down downstream is marked as down right away
+// instead of waiting for the next probe, which brings it back up once it
+// responds again.
+func (s *Server) countError(d *downstream, err error) {
+	atomic.AddUint32(&d.errors, 1)
+	atomic.AddUint32(&s.downstreamErrCnt, 1)
+
+	switch errorKind(err) {
+	case errKindRefused:
+		atomic.AddUint32(&d.refused, 1)
+	case errKindUnreachable:
+		atomic.AddUint32(&d.unreachable, 1)
+	case errKindTimeout:
+		atomic.AddUint32(&d.timeouts, 1)
+		return
+	default:
+		return
+	}
+	if s.healthChecks && d.setUp(false) {
+		log.Println("Downstream", d.name, "is down:", err)
+	}
+}
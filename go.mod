@@ -1,10 +1,15 @@
 module github.com/foxcpp/rhole
 
-go 1.14
+go 1.17
 
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/miekg/dns v1.1.29
+	golang.org/x/crypto v0.14.0
 	golang.org/x/net v0.17.0
 	golang.org/x/sys v0.13.0
 )
+
+require golang.org/x/text v0.13.0 // indirect
+
+require golang.org/x/text v0.13.0 // indirect
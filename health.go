@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func (d *downstream) isUp() bool {
+	return atomic.LoadUint32(&d.down) == 0
+}
+
+// setUp updates the downstream state and reports whether it changed.
+func (d *downstream) setUp(up bool) bool {
+	var down uint32
+	if !up {
+		down = 1
+	}
+	return atomic.SwapUint32(&d.down, down) != down
+}
+
+// checkDownstream sends the probe query to d and reports whether it got a
+// usable response.
+func (s *Server) checkDownstream(d *downstream, probe string) bool {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(probe), dns.TypeSOA)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	resp, err := d.exchange(ctx, msg)
+	if err != nil {
+		return false
+	}
+	return resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError
+}
+
+// probeBackoff tracks consecutive failed health checks of a downstream. After
+// each failure the delay before the next probe is doubled, up to the
+// configured maximum.
+type probeBackoff struct {
+	lock     sync.Mutex
+	failures int
+	delay    time.Duration
+	next     time.Time
+	running  bool
+}
+
+// start reports whether a probe is due at now (within half an interval, so
+// slight ticker drift does not skip a probe) and marks it as running.
+func (b *probeBackoff) start(now time.Time, interval time.Duration) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.running || b.next.Sub(now) > interval/2 {
+		return false
+	}
+	b.running = true
+	return true
+}
+
+// done records the result of the probe started at started.
+func (b *probeBackoff) done(up bool, started time.Time, interval, maxDelay time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.running = false
+	if up {
+		b.failures = 0
+		b.delay = 0
+		b.next = time.Time{}
+		return
+	}
+
+	b.failures++
+	if b.delay == 0 {
+		b.delay = interval
+	} else {
+		b.delay *= 2
+	}
+	if b.delay > maxDelay {
+		b.delay = maxDelay
+	}
+	if b.delay < interval {
+		b.delay = interval
+	}
+	b.next = started.Add(b.delay)
+}
+
+// state returns the number of consecutive failed probes and the current
+// delay between probes, zero if the last probe succeeded.
+func (b *probeBackoff) state() (int, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.failures, b.delay
+}
+
+// healthCheckLoop periodically probes all downstreams and marks them as up or
+// down so exchange can skip dead ones. Downstreams that keep failing are
+// probed exponentially less often, up to once per maxBackoff.
+func (s *Server) healthCheckLoop(interval, maxBackoff time.Duration, probe string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-s.stop:
+			return
+		}
+
+		for _, d := range s.allDownstreams() {
+			if !d.probe.start(now, interval) {
+				continue
+			}
+			go func(d *downstream) {
+				up := s.checkDownstream(d, probe)
+				d.probe.done(up, now, interval, maxBackoff)
+				if !d.setUp(up) {
+					return
+				}
+				if up {
+					log.Println("Downstream", d.name, "is up")
+				} else {
+					log.Println("Downstream", d.name, "is down")
+				}
+			}(d)
+		}
+	}
+}
+
+// serveHealthz is the liveness probe: it succeeds as long as the process
+// handles requests.
+func (s *Server) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// serveReadyz is the readiness probe: it fails with 503 while the server is
+// shutting down, if lists are still loading (see startup_mode) or if all
+// downstreams are down.
+func (s *Server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if reason := s.notReady(); reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// notReady returns why the server cannot answer queries or an empty string
+// if it can.
+func (s *Server) notReady() string {
+	s.closingLock.RLock()
+	closing := s.closing
+	s.closingLock.RUnlock()
+	if closing {
+		return "shutting down"
+	}
+
+	s.listsLock.RLock()
+	loaded := s.lists != nil
+	s.listsLock.RUnlock()
+	if !loaded {
+		return "lists are loading"
+	}
+
+	if !s.recursion {
+		return ""
+	}
+	for _, d := range s.allDownstreams() {
+		if d.isUp() {
+			return ""
+		}
+	}
+	return "all downstreams are down"
+}
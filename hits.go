@@ -0,0 +1,124 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+type hitCount struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// hitCounter counts the most frequent names using a bounded amount of memory.
+//
+// It implements the Space-Saving algorithm: once size names are tracked, a
+// new name replaces the one with the lowest count and inherits that count, so
+// counts of rare names are overestimated but frequent names are reliably
+// kept.
+//
+// Tracked names are kept in a min-heap by count so that the one to replace
+// is found in O(log size).
+type hitCounter struct {
+	lock    sync.Mutex
+	size    int
+	entries hitHeap
+	byName  map[string]*hitEntry
+}
+
+type hitEntry struct {
+	name  string
+	count uint64
+	// Position in hitCounter.entries.
+	index int
+}
+
+// hitHeap implements heap.Interface, the entry with the lowest count is at
+// index 0.
+type hitHeap []*hitEntry
+
+func (h hitHeap) Len() int           { return len(h) }
+func (h hitHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h hitHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hitHeap) Push(x interface{}) {
+	e := x.(*hitEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *hitHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func newHitCounter(size int) *hitCounter {
+	return &hitCounter{
+		size:    size,
+		entries: make(hitHeap, 0, size),
+		byName:  make(map[string]*hitEntry, size),
+	}
+}
+
+func (h *hitCounter) hit(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if e, ok := h.byName[name]; ok {
+		e.count++
+		heap.Fix(&h.entries, e.index)
+		return
+	}
+	if len(h.entries) < h.size {
+		e := &hitEntry{name: name, count: 1}
+		heap.Push(&h.entries, e)
+		h.byName[name] = e
+		return
+	}
+	if len(h.entries) == 0 {
+		return
+	}
+
+	e := h.entries[0]
+	delete(h.byName, e.name)
+	e.name = name
+	e.count++
+	h.byName[name] = e
+	heap.Fix(&h.entries, 0)
+}
+
+// top returns up to n names with the highest counts.
+func (h *hitCounter) top(n int) []hitCount {
+	h.lock.Lock()
+	hits := make([]hitCount, 0, len(h.entries))
+	for _, e := range h.entries {
+		hits = append(hits, hitCount{Name: e.name, Count: e.count})
+	}
+	h.lock.Unlock()
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Count != hits[j].Count {
+			return hits[i].Count > hits[j].Count
+		}
+		return hits[i].Name < hits[j].Name
+	})
+	if len(hits) > n {
+		hits = hits[:n]
+	}
+	return hits
+}
+
+func (h *hitCounter) reset() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.entries = make(hitHeap, 0, h.size)
+	h.byName = make(map[string]*hitEntry, h.size)
+}
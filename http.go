@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// handleHTTP registers handler for path on the HTTP server listening on
+// addr. Servers are created on first use, so several endpoints can share the
+// same address. The server uses HTTPS if tlsConfig is not nil.
+func (s *Server) handleHTTP(addr, path string, handler http.HandlerFunc, tlsConfig *tls.Config) error {
+	if mux, ok := s.httpMuxes[addr]; ok {
+		if s.httpsAddrs[addr] != (tlsConfig != nil) {
+			return fmt.Errorf("%s: HTTP and HTTPS endpoints cannot share the address", addr)
+		}
+		mux.HandleFunc(path, handler)
+		return nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, handler)
+	srv := &http.Server{Handler: mux, TLSConfig: tlsConfig}
+	s.httpMuxes[addr] = mux
+	s.httpsAddrs[addr] = tlsConfig != nil
+	s.httpServers = append(s.httpServers, srv)
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = srv.ServeTLS(l, "", "")
+		} else {
+			err = srv.Serve(l)
+		}
+		if err != http.ErrServerClosed {
+			log.Println("HTTP server failed:", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Files written by compile-lists and used with blacklist_db consist of a
+// header of native-endian uint64 words (magic, listDBByteOrder, bloom filter
+// words, hashes, text length), the bloom filter and sorted hashes of a
+// compactSet, followed by entries that are not plain domains (wildcards,
+// /patterns/, dnsmasq server= lines) in list syntax. The compactSet is used
+// directly from the mapped file, so loading does not depend on the number of
+// domains.
+const (
+	listDBMagic     = "RHOLEDB1"
+	listDBByteOrder = 0x0102030405060708
+	listDBHeader    = 5 * 8
+)
+
+// asWords returns the uint64 words stored in b without copying.
+func asWords(b []byte) []uint64 {
+	var words []uint64
+	if len(b) == 0 {
+		return words
+	}
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&words))
+	hdr.Data = uintptr(unsafe.Pointer(&b[0]))
+	hdr.Len = len(b) / 8
+	hdr.Cap = hdr.Len
+	return words
+}
+
+// asBytes returns the memory of words without copying.
+func asBytes(words []uint64) []byte {
+	var b []byte
+	if len(words) == 0 {
+		return b
+	}
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	hdr.Data = uintptr(unsafe.Pointer(&words[0]))
+	hdr.Len = len(words) * 8
+	hdr.Cap = hdr.Len
+	return b
+}
+
+// writeListDB writes the set to path atomically and returns the amount of
+// domains in it.
+func writeListDB(path string, set *domainSet) (int, error) {
+	c := newCompactSet(set.domains)
+
+	var text bytes.Buffer
+	for domain := range set.wildcards {
+		fmt.Fprintf(&text, "*.%s\n", domain)
+	}
+	for _, re := range set.regexps {
+		fmt.Fprintf(&text, "/%s/\n", re.String())
+	}
+	for suffix, value := range set.forwarders {
+		fmt.Fprintf(&text, "server=/%s/%s\n", suffix, value)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".rhole-db")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	header := make([]uint64, listDBHeader/8)
+	copy(asBytes(header), listDBMagic)
+	header[1] = listDBByteOrder
+	header[2] = uint64(len(c.bloom))
+	header[3] = uint64(len(c.hashes))
+	header[4] = uint64(text.Len())
+
+	w := bufio.NewWriter(f)
+	w.Write(asBytes(header))
+	w.Write(asBytes(c.bloom))
+	w.Write(asBytes(c.hashes))
+	w.Write(text.Bytes())
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return len(c.hashes), os.Rename(f.Name(), path)
+}
+
+// openListDB maps the file written by writeListDB read-only and returns the
+// set using it. The mapping is released once the set is garbage collected.
+func openListDB(path string, cfg Config) (*domainSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < listDBHeader {
+		return nil, fmt.Errorf("%s: not a list database", path)
+	}
+
+	data, err := unix.Mmap(int(f.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c, text, err := parseListDB(data)
+	if err != nil {
+		unix.Munmap(data)
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	runtime.SetFinalizer(c, func(*compactSet) { unix.Munmap(data) })
+
+	set := &domainSet{domains: make(map[string]struct{})}
+	if err := parseList(bytes.NewReader(text), path, set, cfg.RegexLists); err != nil {
+		return nil, err
+	}
+	set.compact = c
+	set.contributions = []listContribution{{Name: path, Added: set.size()}}
+	return set, nil
+}
+
+func parseListDB(data []byte) (*compactSet, []byte, error) {
+	header := asWords(data[:listDBHeader])
+	if string(data[:8]) != listDBMagic {
+		return nil, nil, errors.New("not a list database")
+	}
+	if header[1] != listDBByteOrder {
+		return nil, nil, errors.New("list database was compiled on a machine with different byte order")
+	}
+	bloomWords, hashes, textLen := header[2], header[3], header[4]
+	size := uint64(len(data) - listDBHeader)
+	if bloomWords == 0 || bloomWords > size/8 || hashes > size/8-bloomWords || textLen != size-8*(bloomWords+hashes) {
+		return nil, nil, errors.New("list database is truncated or corrupted")
+	}
+
+	words := asWords(data[listDBHeader : listDBHeader+8*(bloomWords+hashes)])
+	c := &compactSet{
+		bloom:  words[:bloomWords],
+		hashes: words[bloomWords:],
+	}
+	return c, data[listDBHeader+8*(bloomWords+hashes):], nil
+}
+
+// warnStaleListDB logs a warning if local blacklists were modified after the
+// database was compiled.
+func warnStaleListDB(cfg Config) {
+	compiled := modTime(cfg.BlacklistDB)
+	for _, path := range cfg.Blacklists {
+		if !isURL(path) && modTime(path).After(compiled) {
+			log.Printf("WARNING: %s is newer than %s, run compile-lists to update it", path, cfg.BlacklistDB)
+		}
+	}
+}
+
+// runCompileLists implements the compile-lists subcommand, which compiles
+// blacklists into the file used with blacklist_db.
+func runCompileLists(args []string) int {
+	fs := flag.NewFlagSet("compile-lists", flag.ExitOnError)
+	cfgPath := fs.String("config", "/etc/rhole.toml", "configuration file, directory or glob")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s compile-lists [-config path] [output]\n", os.Args[0])
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(*cfgPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	setStrictIDNA(cfg.StrictIDNA)
+	output := cfg.BlacklistDB
+	if fs.NArg() == 1 {
+		output = fs.Arg(0)
+	}
+	if output == "" {
+		fmt.Fprintln(os.Stderr, "no output path specified and blacklist_db is not set")
+		return 2
+	}
+
+	set, err := readLists(cfg.Blacklists, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "blacklist read failed:", err)
+		return 2
+	}
+	n, err := writeListDB(output, set)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("Wrote %d domains, %d wildcards, %d patterns to %s\n", n, len(set.wildcards), len(set.regexps), output)
+	return 0
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// listen creates TCP and UDP sockets bound to addr and DNS servers using
+// them. Servers are started by Serve.
+//
+// addr can end with @interface to accept queries only from that interface,
+// e.g. 0.0.0.0:53@eth0. If reusePort is set, sockets are created with
+// SO_REUSEPORT so several listeners can share the address.
+func (s *Server) listen(addr string, reusePort bool) error {
+	addr, iface := splitInterface(addr)
+	lc := net.ListenConfig{
+		Control: socketControl(iface, reusePort),
+	}
+
+	tcpL, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return err
+	}
+	udpL, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		tcpL.Close()
+		return err
+	}
+	if err := setUDPBuffers(udpL, addr, s.udpReadBuffer, s.udpWriteBuffer); err != nil {
+		tcpL.Close()
+		udpL.Close()
+		return err
+	}
+
+	// dns.Server serves only one of Listener and PacketConn.
+	s.servers = append(s.servers,
+		&dns.Server{Listener: tcpL, Handler: s, MsgAcceptFunc: acceptMsg},
+		&dns.Server{PacketConn: udpL, Handler: s, MsgAcceptFunc: acceptMsg},
+	)
+	return nil
+}
+
+// listenTLS creates a DNS-over-TLS (RFC 7858) server on addr, which can end
+// with @interface as for listen.
+func (s *Server) listenTLS(addr string, reusePort bool, tlsConfig *tls.Config) error {
+	addr, iface := splitInterface(addr)
+	lc := net.ListenConfig{
+		Control: socketControl(iface, reusePort),
+	}
+
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.servers = append(s.servers, &dns.Server{
+		Net:           "tcp-tls",
+		Listener:      tls.NewListener(l, tlsConfig),
+		Handler:       s,
+		MsgAcceptFunc: acceptMsg,
+	})
+	return nil
+}
+
+// splitInterface splits the address into the address itself and the
+// interface name after @, if any.
+func splitInterface(addr string) (string, string) {
+	if indx := strings.LastIndex(addr, "@"); indx != -1 {
+		return addr[:indx], addr[indx+1:]
+	}
+	return addr, ""
+}
+
+// acceptMsg is dns.DefaultMsgAcceptFunc that also passes requests with
+// opcodes other than QUERY and NOTIFY to ServeDNS, so they are rejected with
+// the rcode from opcodeRcode and logged.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	const qrBit = 1 << 15
+	if dh.Bits&qrBit != 0 {
+		return dns.MsgIgnore
+	}
+
+	opcode := int(dh.Bits>>11) & 0xF
+	if opcode != dns.OpcodeQuery && opcode != dns.OpcodeNotify {
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
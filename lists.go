@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// Profile used by normalize, see setStrictIDNA.
+var idnaProfile = idna.Punycode
+
+// strictIDNA applies UTS #46 mapping and validation as for lookups (e.g.
+// fullwidth letters are mapped to ASCII ones, invalid Punycode is rejected),
+// but allows underscores and other characters seen in real-world names.
+var strictIDNA = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// setStrictIDNA selects the IDNA conversion used by normalize. It must be
+// called before lists are loaded and queries are served.
+func setStrictIDNA(strict bool) {
+	if strict {
+		idnaProfile = strictIDNA
+	} else {
+		idnaProfile = idna.Punycode
+	}
+}
+
+// normalize converts the domain name from a list or a query to the form
+// used for lookups: lowercase, IDNA-encoded, without surrounding whitespace
+// and trailing dots. normalize(normalize(d)) == normalize(d) for any d.
+func normalize(domain string) string {
+	norm, _ := normalizeErr(domain)
+	return norm
+}
+
+// normalizeErr is normalize that also returns the IDNA conversion error. The
+// domain is still returned lowercased and trimmed then.
+func normalizeErr(domain string) (string, error) {
+	domain = strings.TrimSpace(domain)
+	domain = strings.ToLower(domain)
+	domain = strings.TrimRight(domain, ".")
+	if !needsIDNA(domain) {
+		return domain, nil
+	}
+	norm, err := idnaProfile.ToASCII(domain)
+	if err != nil {
+		return domain, err
+	}
+	return strings.ToLower(norm), nil
+}
+
+// needsIDNA reports whether the lowercase domain has non-ASCII characters or
+// Punycode labels. Other names are the same in IDNA form, so they are not
+// converted and strict_idna does not reject ASCII names that are not valid
+// hostnames (e.g. r1---sn-example.googlevideo.com).
+func needsIDNA(domain string) bool {
+	for i := 0; i < len(domain); i++ {
+		if domain[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return strings.HasPrefix(domain, "xn--") || strings.Contains(domain, ".xn--")
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// domainSet is the merged content of a set of lists.
+type domainSet struct {
+	domains map[string]struct{}
+	// If set, domains is nil and compact is used instead, unless compact
+	// is loaded from blacklist_db: domains has entries from other sources
+	// (e.g. RPZ zones) then.
+	compact *compactSet
+	// Domains whose subdomains (but not the domain itself) are in the set.
+	wildcards map[string]struct{}
+	regexps   []*regexp.Regexp
+	// Conditional forwarders from dnsmasq server= lines, domain suffix ->
+	// ip[#port].
+	forwarders map[string]string
+
+	// Entries added to domains that were already there.
+	duplicates int
+	// Contributions of read lists in order.
+	contributions []listContribution
+
+	// Entries of the list being read that failed IDNA conversion, see
+	// normalizeEntry.
+	invalid    []string
+	invalidCnt int
+}
+
+// listContribution describes how many domains a list added to a set. Overlap
+// with lists read earlier (and duplicates within the list) counts as
+// duplicates.
+type listContribution struct {
+	Name       string `json:"name"`
+	Category   string `json:"category,omitempty"`
+	Added      int    `json:"added"`
+	Duplicates int    `json:"duplicates"`
+}
+
+func (set *domainSet) add(domain string) {
+	if _, ok := set.domains[domain]; ok {
+		set.duplicates++
+		return
+	}
+	set.domains[domain] = struct{}{}
+}
+
+// track records the domains added to the set since it had size domains and
+// dups duplicates as the contribution of the list name.
+func (set *domainSet) track(name string, size, dups int) {
+	set.reportInvalid(name)
+	set.contributions = append(set.contributions, listContribution{
+		Name:       name,
+		Added:      set.size() - size,
+		Duplicates: set.duplicates - dups,
+	})
+}
+
+// How many entries failing IDNA conversion are logged for each list.
+const maxReportedInvalid = 5
+
+// normalizeEntry is normalize for list entries. Entries failing IDNA
+// conversion are kept (they still match queries with the same spelling), but
+// reported once the list is read, see reportInvalid.
+func (set *domainSet) normalizeEntry(entry string) string {
+	norm, err := normalizeErr(entry)
+	if err != nil {
+		if set.invalidCnt < maxReportedInvalid {
+			set.invalid = append(set.invalid, fmt.Sprintf("%q (%v)", entry, err))
+		}
+		set.invalidCnt++
+	}
+	return norm
+}
+
+// reportInvalid logs entries of the list name that failed IDNA conversion.
+func (set *domainSet) reportInvalid(name string) {
+	if set.invalidCnt == 0 {
+		return
+	}
+	log.Printf("%d entries in %s are not valid domain names and may not match queries: %s",
+		set.invalidCnt, name, strings.Join(set.invalid, ", "))
+	set.invalid, set.invalidCnt = nil, 0
+}
+
+func (set *domainSet) contains(name string) bool {
+	if set.compact != nil && set.compact.contains(name) {
+		return true
+	}
+	_, ok := set.domains[name]
+	return ok
+}
+
+func (set *domainSet) addWildcard(domain string) {
+	if set.wildcards == nil {
+		set.wildcards = make(map[string]struct{})
+	}
+	set.wildcards[domain] = struct{}{}
+}
+
+// match returns the entry the normalized name matches: the name itself, a
+// parent domain (only if subdomains is set), a *.wildcard entry or a
+// /pattern/.
+func (set *domainSet) match(name string, subdomains bool) (string, bool) {
+	if set.contains(name) {
+		return name, true
+	}
+	for parent := parentDomain(name); parent != ""; parent = parentDomain(parent) {
+		if subdomains && set.contains(parent) {
+			return parent, true
+		}
+		if _, ok := set.wildcards[parent]; ok {
+			return "*." + parent, true
+		}
+	}
+	for _, re := range set.regexps {
+		if re.MatchString(name) {
+			return "/" + re.String() + "/", true
+		}
+	}
+	return "", false
+}
+
+func (set *domainSet) size() int {
+	n := len(set.domains)
+	if set.compact != nil {
+		n += len(set.compact.hashes)
+	}
+	return n
+}
+
+// empty reports whether the set matches nothing.
+func (set *domainSet) empty() bool {
+	return set.size() == 0 && len(set.wildcards) == 0 && len(set.regexps) == 0
+}
+
+// compactify replaces the domains map with a compactSet to save memory.
+func (set *domainSet) compactify() {
+	if set.compact != nil {
+		// Loaded from blacklist_db.
+		return
+	}
+	set.compact = newCompactSet(set.domains)
+	set.domains = nil
+
+	bloomFP, totalFP := set.compact.falsePositiveRates()
+	log.Printf("Compact blacklist uses %.1f MiB, estimated false positive rate is %.2g (bloom filter %.2g)",
+		float64(set.compact.sizeBytes())/(1024*1024), totalFP, bloomFP)
+}
+
+func newDomainSet() *domainSet {
+	return &domainSet{
+		domains: make(map[string]struct{}, 50000),
+	}
+}
+
+// newRPZNODATASet returns the set for domainLists.nodata, it is usually
+// small so no space is preallocated.
+func newRPZNODATASet() *domainSet {
+	return &domainSet{
+		domains: make(map[string]struct{}),
+	}
+}
+
+// parseRegexp returns the pattern if line is a regular expression entry
+// written as /pattern/ or re:pattern.
+func parseRegexp(line string) (string, bool) {
+	if strings.HasPrefix(line, "re:") {
+		return strings.TrimPrefix(line, "re:"), true
+	}
+	if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		return line[1 : len(line)-1], true
+	}
+	return "", false
+}
+
+// gunzip returns r or, if it starts with the gzip magic number, a reader
+// of the decompressed data.
+func gunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		// Too short lists are read as is.
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
+
+// parseList reads the list from r, which can be gzip-compressed. name is
+// used in logs.
+func parseList(r io.Reader, name string, set *domainSet, allowRegexps bool) error {
+	r, err := gunzip(r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	skipped := 0
+	defer func() {
+		if skipped != 0 {
+			log.Printf("Skipped %d unsupported AdBlock rules in %s", skipped, name)
+		}
+	}()
+	size, dups := set.size(), set.duplicates
+
+	scnr := bufio.NewScanner(r)
+	lineNo := 0
+	for scnr.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scnr.Text())
+		if isDnsmasqDirective(line) {
+			if err := parseDnsmasq(line, set); err != nil {
+				log.Printf("Skipping invalid line %q: %v", line, err)
+			}
+			continue
+		}
+		if isAdblockRule(line) {
+			if !parseAdblock(line, set) {
+				skipped++
+			}
+			continue
+		}
+		if indx := strings.Index(line, "#"); indx != -1 {
+			line = line[:indx]
+		}
+		line = strings.TrimSpace(line)
+
+		if pattern, ok := parseRegexp(line); ok {
+			if !allowRegexps {
+				continue
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", name, lineNo, err)
+			}
+			set.regexps = append(set.regexps, re)
+			continue
+		}
+
+		parts := strings.Fields(line)
+
+		// hosts(5)-style entry, e.g. "0.0.0.0 ads.example.org", block
+		// all listed names and ignore the address itself.
+		if len(parts) != 0 && net.ParseIP(parts[0]) != nil {
+			parts = parts[1:]
+		}
+
+		for _, part := range parts {
+			if strings.HasPrefix(part, "*.") {
+				set.addWildcard(set.normalizeEntry(part[2:]))
+				continue
+			}
+			set.add(set.normalizeEntry(part))
+		}
+	}
+	if err := scnr.Err(); err != nil {
+		return err
+	}
+	set.track(name, size, dups)
+	return nil
+}
+
+func listCachePath(cacheDir, url string) string {
+	sum := sha1.Sum([]byte(url))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:]))
+}
+
+// fetchList downloads the list from url and saves a copy to cachePath. If the
+// download fails, the previously saved copy is returned instead.
+func fetchList(cl *http.Client, url, cachePath string) ([]byte, error) {
+	body, err := download(cl, url)
+	if err != nil {
+		log.Printf("Failed to fetch %s: %v", url, err)
+
+		body, cacheErr := ioutil.ReadFile(cachePath)
+		if cacheErr != nil {
+			return nil, err
+		}
+		log.Printf("Using cached copy of %s", url)
+		return body, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		log.Printf("Failed to save %s: %v", url, err)
+		return body, nil
+	}
+	tmpPath := cachePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, body, 0644); err != nil {
+		log.Printf("Failed to save %s: %v", url, err)
+		return body, nil
+	}
+	if err := os.Rename(tmpPath, cachePath); err != nil {
+		log.Printf("Failed to save %s: %v", url, err)
+	}
+
+	return body, nil
+}
+
+func download(cl *http.Client, url string) ([]byte, error) {
+	resp, err := cl.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func readLists(paths []string, cfg Config) (*domainSet, error) {
+	set := newDomainSet()
+
+	cl := &http.Client{
+		Timeout: time.Duration(cfg.ListFetchTimeoutSecs) * time.Second,
+	}
+	loaded := 0
+
+	for _, path := range paths {
+		if isURL(path) {
+			body, err := fetchList(cl, path, listCachePath(cfg.ListCacheDir, path))
+			if err != nil {
+				continue
+			}
+			if err := parseList(bytes.NewReader(body), path, set, cfg.RegexLists); err != nil {
+				return nil, err
+			}
+			loaded++
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			loaded += readListDir(path, set, cfg)
+			continue
+		}
+
+		if err := readListFile(path, set, cfg); err != nil {
+			return nil, err
+		}
+		loaded++
+	}
+
+	if loaded == 0 && len(paths) != 0 {
+		return nil, errors.New("no lists could be loaded")
+	}
+	if len(set.regexps) > cfg.MaxRegexPatterns {
+		return nil, fmt.Errorf("too many regexp patterns: %d, max_regex_patterns is %d", len(set.regexps), cfg.MaxRegexPatterns)
+	}
+
+	return set, nil
+}
+
+func readListFile(path string, set *domainSet, cfg Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return parseList(file, path, set, cfg.RegexLists)
+}
+
+// readListDir reads all regular files in dir with one of cfg.ListExtensions
+// (all files if it is empty), hidden files are skipped. Files that cannot be
+// read are logged and skipped. The amount of read files is returned.
+func readListDir(dir string, set *domainSet, cfg Config) int {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("Failed to read %s: %v", dir, err)
+		return 0
+	}
+
+	loaded := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !hasListExtension(name, cfg.ListExtensions) {
+			continue
+		}
+
+		// Stat again to follow symlinks.
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Failed to read %s: %v", path, err)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if err := readListFile(path, set, cfg); err != nil {
+			log.Printf("Failed to read %s: %v", path, err)
+			continue
+		}
+		loaded++
+	}
+	return loaded
+}
+
+// hasListExtension reports whether name ends with one of exts, a .gz suffix
+// is ignored.
+func hasListExtension(name string, exts []string) bool {
+	if len(exts) == 0 {
+		return true
+	}
+	name = strings.TrimSuffix(name, ".gz")
+	for _, ext := range exts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+type domainLists struct {
+	black *domainSet
+	// Blacklists from categories, consulted only for enabled categories.
+	categories []*listCategory
+	// Consulted for every blacklisted name, see isBlocked. Exact whitelist
+	// entries are also removed from black on load.
+	white *domainSet
+
+	// Conditional forwarders by domain suffix.
+	forwarders map[string]*downstream
+
+	// Names from black that RPZ zones block with the NODATA action, see
+	// parseRPZ.
+	nodata *domainSet
+
+	// Contributions of blacklists, including categories, see logOverlap.
+	contributions []listContribution
+}
+
+type listCategory struct {
+	name  string
+	black *domainSet
+}
+
+// categoryStates returns initial states of categories for
+// Server.disabledCategories.
+func categoryStates(categories []CategoryConfig) map[string]bool {
+	states := make(map[string]bool, len(categories))
+	for _, c := range categories {
+		states[c.Name] = c.Disabled
+	}
+	return states
+}
+
+// matchBlack returns the blacklist entry matching the normalized name (see
+// domainSet.match) and the category of the list it is from, empty for lists
+// outside of categories. Categories in disabled are skipped.
+func (l *domainLists) matchBlack(name string, subdomains bool, disabled map[string]bool) (rule, category string, ok bool) {
+	if rule, ok := l.black.match(name, subdomains); ok {
+		return rule, "", true
+	}
+	for _, c := range l.categories {
+		if disabled[c.name] {
+			continue
+		}
+		if rule, ok := c.black.match(name, subdomains); ok {
+			return rule, c.name, true
+		}
+	}
+	return "", "", false
+}
+
+// size returns the amount of blacklisted domains, including disabled
+// categories.
+func (l *domainLists) size() int {
+	n := l.black.size()
+	for _, c := range l.categories {
+		n += c.black.size()
+	}
+	return n
+}
+
+// logOverlap logs how many new and duplicate domains each blacklist
+// contributed, which shows lists that add little on top of the others.
+func (l *domainLists) logOverlap() {
+	if len(l.contributions) < 2 {
+		return
+	}
+	added, dups := 0, 0
+	for _, src := range l.contributions {
+		name := src.Name
+		if src.Category != "" {
+			name += " (category " + src.Category + ")"
+		}
+		log.Printf("Blacklist %s added %d new domains, %d duplicates", name, src.Added, src.Duplicates)
+		added += src.Added
+		dups += src.Duplicates
+	}
+	overlap := 0.0
+	if added+dups != 0 {
+		overlap = float64(dups) / float64(added+dups) * 100
+	}
+	log.Printf("Blacklists have %d domains, %d duplicate entries (%.1f%% overlap)", added, dups, overlap)
+}
+
+// checkBlacklist returns an error if blacklists are configured but nothing
+// was loaded from them, which usually means they are broken and rhole would
+// run as a plain (possibly open) resolver. In allowlist mode, the whitelists
+// are checked instead since nothing would be resolved with empty ones. Only a
+// warning is logged if allow_empty_blacklist is set.
+func checkBlacklist(cfg Config, l *domainLists) error {
+	if cfg.Mode == modeAllowlist {
+		if !l.white.empty() {
+			return nil
+		}
+		if cfg.AllowEmptyBlacklist {
+			log.Println("WARNING: Whitelists are empty, all queries will be blocked")
+			return nil
+		}
+		return errors.New("whitelists are empty in allowlist mode, set allow_empty_blacklist to use them anyway")
+	}
+	if len(cfg.Blacklists) == 0 && len(cfg.RPZZones) == 0 && len(cfg.Categories) == 0 {
+		return nil
+	}
+	if !l.black.empty() {
+		return nil
+	}
+	for _, c := range l.categories {
+		if !c.black.empty() {
+			return nil
+		}
+	}
+	if cfg.AllowEmptyBlacklist {
+		log.Println("WARNING: Blacklists are empty, no queries will be blocked")
+		return nil
+	}
+	return errors.New("blacklists are empty, set allow_empty_blacklist to use them anyway")
+}
+
+// loadLists reads all configured blacklists and whitelists. disabled has the
+// current states of categories, used for dump_effective_list.
+func loadLists(cfg Config, disabled map[string]bool) (*domainLists, error) {
+	var black *domainSet
+	var err error
+	if cfg.BlacklistDB != "" {
+		warnStaleListDB(cfg)
+		black, err = openListDB(cfg.BlacklistDB, cfg)
+	} else {
+		black, err = readLists(cfg.Blacklists, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("blacklist read failed: %w", err)
+	}
+	white, err := readLists(cfg.Whitelists, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("whitelist read failed: %w", err)
+	}
+	nodata := newRPZNODATASet()
+	if err := readRPZ(cfg.RPZZones, cfg, black, white, nodata); err != nil {
+		return nil, fmt.Errorf("RPZ read failed: %w", err)
+	}
+	sets := []*domainSet{black, white}
+	categories := make([]*listCategory, 0, len(cfg.Categories))
+	for _, c := range cfg.Categories {
+		set, err := readLists(c.Blacklists, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("category %s: blacklist read failed: %w", c.Name, err)
+		}
+		categories = append(categories, &listCategory{name: c.Name, black: set})
+		sets = append(sets, set)
+	}
+
+	for ent := range white.domains {
+		delete(black.domains, ent)
+		for _, c := range categories {
+			delete(c.black.domains, ent)
+		}
+	}
+
+	forwarders := make(map[string]*downstream)
+	timeouts := configTimeouts(cfg)
+	for _, set := range sets {
+		for suffix, value := range set.forwarders {
+			d, err := parseForwarder(value, cfg.DownstreamNet, timeouts)
+			if err != nil {
+				return nil, err
+			}
+			forwarders[suffix] = d
+		}
+	}
+
+	l := &domainLists{black: black, white: white, categories: categories, forwarders: forwarders, nodata: nodata}
+	l.contributions = append(l.contributions, black.contributions...)
+	for _, c := range categories {
+		for _, src := range c.black.contributions {
+			src.Category = c.name
+			l.contributions = append(l.contributions, src)
+		}
+	}
+	l.logOverlap()
+
+	// Compact sets cannot be dumped.
+	if cfg.DumpEffectiveList != "" {
+		n, err := dumpEffectiveList(cfg.DumpEffectiveList, l, disabled)
+		if err != nil {
+			log.Println("Failed to dump effective list:", err)
+		} else {
+			log.Println("Wrote", n, "blocked entries to", cfg.DumpEffectiveList)
+		}
+	}
+
+	if cfg.CompactBlacklist {
+		black.compactify()
+		for _, c := range categories {
+			c.black.compactify()
+		}
+	}
+
+	return l, nil
+}
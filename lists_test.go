@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseListHosts(t *testing.T) {
+	cases := []struct {
+		line    string
+		blocked []string
+		allowed []string
+	}{
+		{"0.0.0.0 ads.example.com", []string{"ads.example.com"}, []string{"0.0.0.0"}},
+		{"127.0.0.1 ads.example.com", []string{"ads.example.com"}, []string{"127.0.0.1"}},
+		{"::1 ads.example.com", []string{"ads.example.com"}, []string{"::1"}},
+		{"::  ads.example.com", []string{"ads.example.com"}, []string{"::"}},
+		{"0.0.0.0\tads.example.com tracker.example.com", []string{"ads.example.com", "tracker.example.com"}, []string{"0.0.0.0"}},
+		{"0.0.0.0 ads.example.com # comment", []string{"ads.example.com"}, []string{"comment"}},
+		{"ads.example.com", []string{"ads.example.com"}, nil},
+		{"# 0.0.0.0 ads.example.com", nil, []string{"ads.example.com"}},
+	}
+	for _, c := range cases {
+		set := newDomainSet()
+		if err := parseList(strings.NewReader(c.line), "test", set, false); err != nil {
+			t.Fatalf("%q: %v", c.line, err)
+		}
+		for _, name := range c.blocked {
+			if !set.contains(name) {
+				t.Errorf("%q: %s is not listed", c.line, name)
+			}
+		}
+		for _, name := range c.allowed {
+			if set.contains(name) {
+				t.Errorf("%q: %s is listed", c.line, name)
+			}
+		}
+	}
+}
+
+func TestParseListMixed(t *testing.T) {
+	list := strings.Join([]string{
+		"plain.example.com",
+		"0.0.0.0 hosts.example.com",
+		"2001:db8::1 v6.example.com",
+		"",
+		"another.example.com",
+	}, "\n")
+	set := newDomainSet()
+	if err := parseList(strings.NewReader(list), "test", set, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"plain.example.com", "hosts.example.com", "v6.example.com", "another.example.com"} {
+		if !set.contains(name) {
+			t.Errorf("%s is not listed", name)
+		}
+	}
+	if n := set.size(); n != 4 {
+		t.Errorf("%d entries listed, expected 4", n)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		entry string
+		query string
+		norm  string
+	}{
+		{"example.com", "example.com.", "example.com"},
+		{"Example.COM", "eXample.com.", "example.com"},
+		{"example.com.", "example.com.", "example.com"},
+		{"example.com..", "EXAMPLE.COM.", "example.com"},
+		{" example.com\t", "example.com.", "example.com"},
+		{"bücher.example", "xn--bcher-kva.example.", "xn--bcher-kva.example"},
+		{"BÜCHER.example.", "XN--BCHER-KVA.EXAMPLE.", "xn--bcher-kva.example"},
+		{"r1---sn-a.example.com", "R1---SN-A.example.com.", "r1---sn-a.example.com"},
+	}
+	for _, c := range cases {
+		entry, query := normalize(c.entry), normalize(c.query)
+		if entry != c.norm {
+			t.Errorf("entry %q: normalized to %q, expected %q", c.entry, entry, c.norm)
+		}
+		if query != c.norm {
+			t.Errorf("query %q: normalized to %q, expected %q", c.query, query, c.norm)
+		}
+		if again := normalize(entry); again != entry {
+			t.Errorf("entry %q: normalize is not idempotent: %q, then %q", c.entry, entry, again)
+		}
+
+		set := newDomainSet()
+		if err := parseList(strings.NewReader(c.entry+"\n"), "test", set, false); err != nil {
+			t.Fatal(err)
+		}
+		if !set.contains(query) {
+			t.Errorf("list entry %q does not match query %q", c.entry, c.query)
+		}
+	}
+}
+
+func TestParseListDnsmasq(t *testing.T) {
+	list := strings.Join([]string{
+		"address=/ads.example.org/",
+		"address=/tracker.example.net/metrics.example.net/0.0.0.0",
+		"address=/v6.example.com/::",
+	}, "\n")
+	set := newDomainSet()
+	if err := parseList(strings.NewReader(list), "test", set, false); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		blocked bool
+	}{
+		{"ads.example.org", true},
+		// dnsmasq matches subdomains regardless of block_subdomains.
+		{"cdn.ads.example.org", true},
+		{"a.b.ads.example.org", true},
+		{"example.org", false},
+		{"notads.example.org", false},
+		{"tracker.example.net", true},
+		{"x.metrics.example.net", true},
+		{"v6.example.com", true},
+		{"sub.v6.example.com", true},
+	}
+	for _, c := range cases {
+		if _, blocked := set.match(c.name, false); blocked != c.blocked {
+			t.Errorf("%s: blocked is %v, expected %v", c.name, blocked, c.blocked)
+		}
+	}
+}
+
+func TestParseListBadRegexp(t *testing.T) {
+	list := "ads.example.com\n/^tracker[0-9]+\\./\n/^ads(/\n"
+	err := parseList(strings.NewReader(list), "bad.txt", newDomainSet(), true)
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if !strings.HasPrefix(err.Error(), "bad.txt:3: ") {
+		t.Errorf("error is %q, expected it to start with the list name and line", err)
+	}
+}
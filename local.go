@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+type localKey struct {
+	name  string
+	qtype uint16
+}
+
+// localRecords contains records configured in local_records that are
+// answered without contacting downstreams.
+type localRecords struct {
+	records map[localKey][]dns.RR
+	// All names that have records, used to answer NODATA for other types.
+	names map[string]struct{}
+}
+
+func (l *localRecords) add(rr dns.RR) {
+	hdr := rr.Header()
+	name := normalize(hdr.Name)
+
+	key := localKey{name: name, qtype: hdr.Rrtype}
+	l.records[key] = append(l.records[key], rr)
+	l.names[name] = struct{}{}
+}
+
+// newLocalRecords builds records from the local_records configuration.
+// Values are IPv4 addresses for A records, IPv6 addresses for AAAA records
+// and domain names for CNAME records.
+//
+// If ptr is true, PTR records are also created for all addresses.
+func newLocalRecords(cfg map[string]stringList, ttl uint32, ptr bool) (*localRecords, error) {
+	l := &localRecords{
+		records: make(map[localKey][]dns.RR),
+		names:   make(map[string]struct{}),
+	}
+
+	for name, values := range cfg {
+		owner := dns.Fqdn(normalize(name))
+		if _, ok := dns.IsDomainName(owner); !ok {
+			return nil, fmt.Errorf("local_records: malformed name: %s", name)
+		}
+
+		for _, value := range values {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				target := dns.Fqdn(normalize(value))
+				if _, ok := dns.IsDomainName(target); !ok {
+					return nil, fmt.Errorf("local_records: %s: malformed value: %s", name, value)
+				}
+				if len(values) != 1 {
+					return nil, fmt.Errorf("local_records: %s: CNAME cannot be combined with other records", name)
+				}
+				l.add(&dns.CNAME{
+					Hdr:    dns.RR_Header{Name: owner, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+					Target: target,
+				})
+				continue
+			}
+
+			if ip4 := ip.To4(); ip4 != nil {
+				l.add(&dns.A{
+					Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+					A:   ip4,
+				})
+			} else {
+				l.add(&dns.AAAA{
+					Hdr:  dns.RR_Header{Name: owner, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+					AAAA: ip,
+				})
+			}
+
+			if ptr {
+				arpa, err := dns.ReverseAddr(value)
+				if err != nil {
+					return nil, fmt.Errorf("local_records: %s: %w", name, err)
+				}
+				l.add(&dns.PTR{
+					Hdr: dns.RR_Header{Name: arpa, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+					Ptr: owner,
+				})
+			}
+		}
+	}
+
+	return l, nil
+}
+
+// lookup returns records for the normalized name and type. CNAMEs are
+// followed if their targets are local too. ok is false if there are no local
+// records for the name at all.
+func (l *localRecords) lookup(name string, qtype uint16) (answer []dns.RR, ok bool) {
+	if _, ok := l.names[name]; !ok {
+		return nil, false
+	}
+
+	// Bound the amount of followed CNAMEs in case of loops.
+	for i := 0; i < 8; i++ {
+		if rrs, ok := l.records[localKey{name: name, qtype: qtype}]; ok {
+			return append(answer, rrs...), true
+		}
+		cname, ok := l.records[localKey{name: name, qtype: dns.TypeCNAME}]
+		if !ok || qtype == dns.TypeCNAME {
+			break
+		}
+		answer = append(answer, cname...)
+		name = normalize(cname[0].(*dns.CNAME).Target)
+	}
+	return answer, true
+}
+
+// localReply returns an authoritative response for m if the queried name has
+// local records. nil is returned otherwise.
+func (s *Server) localReply(m *dns.Msg, name string) *dns.Msg {
+	if s.local == nil {
+		return nil
+	}
+	q := m.Question[0]
+	rrs, ok := s.local.lookup(name, q.Qtype)
+	if !ok {
+		return nil
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	reply.Authoritative = true
+	reply.RecursionAvailable = s.recursion
+	owner := dns.Fqdn(name)
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		// Preserve the case used in the query for all records of the
+		// queried name, but not for ones of followed CNAME targets.
+		if rr.Header().Name == owner {
+			rr.Header().Name = q.Name
+		}
+		reply.Answer = append(reply.Answer, rr)
+	}
+	if len(reply.Answer) == 0 {
+		reply.Ns = []dns.RR{s.blockSOARR(q)}
+	}
+	return reply
+}
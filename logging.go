@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// setupLogging directs the standard logger to stdout, stderr or syslog.
+func setupLogging(target string) error {
+	switch target {
+	case "stderr":
+		log.SetOutput(os.Stderr)
+	case "stdout":
+		log.SetOutput(os.Stdout)
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "rhole")
+		if err != nil {
+			return fmt.Errorf("syslog: %w", err)
+		}
+		log.SetOutput(syslogWriter{w: w})
+	default:
+		return fmt.Errorf("unknown log_target: %s", target)
+	}
+	return nil
+}
+
+// Prefix of debug messages, see syslogWriter.
+const debugPrefix = "Debug: "
+
+// syslogWriter sends each log message to syslog. The log package has no
+// severity levels, so messages starting with "Debug: " are logged as
+// LOG_DEBUG, errors and failures are recognized by their text and logged as
+// LOG_ERR, everything else is LOG_INFO.
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func (sw syslogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	var err error
+	if strings.HasPrefix(msg, debugPrefix) {
+		err = sw.w.Debug(strings.TrimPrefix(msg, debugPrefix))
+	} else if isErrorMessage(msg) {
+		err = sw.w.Err(msg)
+	} else {
+		err = sw.w.Info(msg)
+	}
+	return len(p), err
+}
+
+func isErrorMessage(msg string) bool {
+	lower := strings.ToLower(msg)
+	return strings.Contains(lower, "error") ||
+		strings.Contains(lower, "failed") ||
+		strings.HasPrefix(msg, "WriteMsg")
+}
+
+// logLimiter limits messages logged for each query, such as ones about
+// malformed names, to one per interval so clients cannot flood the log.
+type logLimiter struct {
+	interval time.Duration
+
+	lock sync.Mutex
+	next time.Time
+	// Messages dropped since the last logged one.
+	suppressed int
+}
+
+// printf logs the message unless another one was logged during the last
+// interval. The number of dropped messages is appended to the next logged
+// one.
+func (l *logLimiter) printf(format string, args ...interface{}) {
+	now := time.Now()
+	l.lock.Lock()
+	if now.Before(l.next) {
+		l.suppressed++
+		l.lock.Unlock()
+		return
+	}
+	suppressed := l.suppressed
+	l.suppressed = 0
+	l.next = now.Add(l.interval)
+	l.lock.Unlock()
+
+	msg := fmt.Sprintf(format, args...)
+	if suppressed != 0 {
+		msg += fmt.Sprintf(" (%d similar messages suppressed)", suppressed)
+	}
+	log.Print(msg)
+}
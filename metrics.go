@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var latencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// histogram is a lock-free Prometheus-style latency histogram.
+type histogram struct {
+	// Cumulative counts are computed at exposition time, each counter only
+	// holds observations that fell into its own bucket.
+	counts []uint64
+	sumUs  uint64
+	total  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{
+		counts: make([]uint64, len(latencyBuckets)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	for i, bound := range latencyBuckets {
+		if d <= bound {
+			atomic.AddUint64(&h.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.sumUs, uint64(d/time.Microsecond))
+	atomic.AddUint64(&h.total, 1)
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	cumulative := uint64(0)
+	for i, bound := range latencyBuckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), cumulative)
+	}
+	total := atomic.LoadUint64(&h.total)
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, total)
+	fmt.Fprintf(w, "%s_sum %g\n", name, float64(atomic.LoadUint64(&h.sumUs))/1e6)
+	fmt.Fprintf(w, "%s_count %d\n", name, total)
+}
+
+// How many recent round-trip times are kept per downstream to compute
+// percentiles.
+const rttWindowSize = 1024
+
+// rttWindow holds the last rttWindowSize round-trip times of a downstream.
+type rttWindow struct {
+	lock    sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func newRTTWindow() *rttWindow {
+	return &rttWindow{samples: make([]time.Duration, 0, rttWindowSize)}
+}
+
+func (r *rttWindow) observe(d time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.samples) < rttWindowSize {
+		r.samples = append(r.samples, d)
+		return
+	}
+	r.samples[r.next] = d
+	r.next = (r.next + 1) % rttWindowSize
+}
+
+// percentiles returns the round-trip times below which the pcts fraction of
+// samples is (nearest-rank), all zero if there are no samples.
+func (r *rttWindow) percentiles(pcts ...float64) []time.Duration {
+	r.lock.Lock()
+	sorted := make([]time.Duration, len(r.samples))
+	copy(sorted, r.samples)
+	r.lock.Unlock()
+
+	res := make([]time.Duration, len(pcts))
+	if len(sorted) == 0 {
+		return res
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, p := range pcts {
+		rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		res[i] = sorted[rank]
+	}
+	return res
+}
+
+var rttQuantiles = []float64{0.5, 0.95, 0.99}
+
+func writeCounter(w io.Writer, name, help string, value uint32) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeCounter(w, "rhole_queries_total", "Total amount of processed queries.", atomic.LoadUint32(&s.totalCnt))
+	writeCounter(w, "rhole_blocked_queries_total", "Amount of queries for blocked domains.", atomic.LoadUint32(&s.blockedCnt))
+	writeCounter(w, "rhole_qtype_blocked_queries_total", "Amount of queries blocked by record type.", atomic.LoadUint32(&s.qtypeBlockedCnt))
+	writeCounter(w, "rhole_rate_limited_queries_total", "Amount of queries dropped due to client rate limit.", atomic.LoadUint32(&s.rateLimitedCnt))
+	writeCounter(w, "rhole_idna_errors_total", "Amount of query names that failed IDNA conversion.", atomic.LoadUint32(&s.idnaErrCnt))
+	writeCounter(w, "rhole_downstream_errors_total", "Amount of failed downstream exchanges.", atomic.LoadUint32(&s.downstreamErrCnt))
+	writeCounter(w, "rhole_downstream_retries_total", "Amount of downstream exchanges retried after a failure.", atomic.LoadUint32(&s.retryCnt))
+	if s.validTLDs != nil {
+		writeCounter(w, "rhole_invalid_tld_queries_total", "Amount of queries for names in unknown TLDs.", atomic.LoadUint32(&s.invalidTLDCnt))
+	}
+	if s.rebindMode != rebindOff {
+		writeCounter(w, "rhole_rebind_filtered_responses_total", "Amount of downstream responses with private addresses filtered by rebind_protection.", atomic.LoadUint32(&s.rebindCnt))
+	}
+	if s.exchangeSlots != nil {
+		writeCounter(w, "rhole_downstream_inflight_limited_total", "Amount of downstream exchanges not started due to max_inflight_downstream.", atomic.LoadUint32(&s.inflightLimitedCnt))
+	}
+	if s.externalPolicy != nil {
+		writeCounter(w, "rhole_external_policy_errors_total", "Amount of queries decided using lists because external_policy failed or too many were running.", atomic.LoadUint32(&s.externalPolicyErrCnt))
+	}
+	if s.cache != nil {
+		writeCounter(w, "rhole_cache_hits_total", "Amount of queries answered from cache.", atomic.LoadUint32(&s.cacheHitCnt))
+		writeCounter(w, "rhole_cache_misses_total", "Amount of cacheable queries not found in cache.", atomic.LoadUint32(&s.cacheMissCnt))
+		writeCounter(w, "rhole_cache_stale_hits_total", "Amount of expired cached responses served while refreshing them.", atomic.LoadUint32(&s.staleHitCnt))
+	}
+
+	fmt.Fprintf(w, "# HELP rhole_downstream_latency_seconds Round-trip time of downstream exchanges.\n")
+	s.downstreamLatency.write(w, "rhole_downstream_latency_seconds")
+
+	downstreams := s.allDownstreams()
+	fmt.Fprintf(w, "# HELP rhole_downstream_rtt_seconds Round-trip time of recent exchanges by downstream.\n")
+	fmt.Fprintf(w, "# TYPE rhole_downstream_rtt_seconds summary\n")
+	for _, d := range downstreams {
+		for i, rtt := range d.rtt.percentiles(rttQuantiles...) {
+			fmt.Fprintf(w, "rhole_downstream_rtt_seconds{downstream=%q,quantile=\"%g\"} %g\n", d.name, rttQuantiles[i], rtt.Seconds())
+		}
+	}
+	fmt.Fprintf(w, "# HELP rhole_downstream_exchanges_total Amount of exchanges by downstream.\n")
+	fmt.Fprintf(w, "# TYPE rhole_downstream_exchanges_total counter\n")
+	for _, d := range downstreams {
+		fmt.Fprintf(w, "rhole_downstream_exchanges_total{downstream=%q} %d\n", d.name, atomic.LoadUint32(&d.queries))
+	}
+	fmt.Fprintf(w, "# HELP rhole_downstream_exchange_errors_total Amount of failed exchanges by downstream.\n")
+	fmt.Fprintf(w, "# TYPE rhole_downstream_exchange_errors_total counter\n")
+	for _, d := range downstreams {
+		fmt.Fprintf(w, "rhole_downstream_exchange_errors_total{downstream=%q} %d\n", d.name, atomic.LoadUint32(&d.errors))
+	}
+	if s.breaker != nil {
+		fmt.Fprintf(w, "# HELP rhole_downstream_circuit_state Circuit breaker state by downstream, 1 for the current one.\n")
+		fmt.Fprintf(w, "# TYPE rhole_downstream_circuit_state gauge\n")
+		for _, d := range downstreams {
+			current := d.breaker.current()
+			for _, state := range []string{circuitClosed, circuitOpen, circuitHalfOpen} {
+				value := 0
+				if state == current {
+					value = 1
+				}
+				fmt.Fprintf(w, "rhole_downstream_circuit_state{downstream=%q,state=%q} %d\n", d.name, state, value)
+			}
+		}
+	}
+}
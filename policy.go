@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Answers of the external policy program.
+const (
+	policyAllow   = "allow"
+	policyBlock   = "block"
+	policyDefault = "default"
+)
+
+type policyKey struct {
+	client string
+	name   string
+}
+
+type policyDecision struct {
+	// One of policyAllow, policyBlock or policyDefault.
+	verdict string
+	expires time.Time
+}
+
+// policyCall is a program run for a policyKey, concurrent queries for the
+// same key wait for it instead of running the program again.
+type policyCall struct {
+	done    chan struct{}
+	verdict string
+	err     error
+}
+
+var errPolicyBusy = errors.New("external_policy: too many programs running")
+
+// externalPolicy asks an external program whether a query should be
+// blocked. The program is run for each query not in the cache with "--", the
+// client address and the normalized name appended to its arguments and must
+// print allow, block or default (use lists as usual) within the timeout.
+type externalPolicy struct {
+	command  []string
+	timeout  time.Duration
+	cacheTTL time.Duration
+	// Semaphore limiting the number of running programs.
+	procs chan struct{}
+
+	lock  sync.Mutex
+	cache map[policyKey]policyDecision
+	calls map[policyKey]*policyCall
+}
+
+func newExternalPolicy(command []string, timeout, cacheTTL time.Duration, maxProcs int) *externalPolicy {
+	return &externalPolicy{
+		command:  command,
+		timeout:  timeout,
+		cacheTTL: cacheTTL,
+		procs:    make(chan struct{}, maxProcs),
+		cache:    make(map[policyKey]policyDecision),
+		calls:    make(map[policyKey]*policyCall),
+	}
+}
+
+// decide returns the verdict for the query for name from client. Cached
+// verdicts are used if not expired, errors are not cached. If the program is
+// already running for the same client and name, its verdict is waited for.
+// errPolicyBusy is returned without running the program if too many are
+// running already.
+func (p *externalPolicy) decide(client net.IP, name string) (string, error) {
+	key := policyKey{client: client.String(), name: name}
+	now := time.Now()
+
+	p.lock.Lock()
+	if d, ok := p.cache[key]; ok && now.Before(d.expires) {
+		p.lock.Unlock()
+		return d.verdict, nil
+	}
+	if c, ok := p.calls[key]; ok {
+		p.lock.Unlock()
+		<-c.done
+		return c.verdict, c.err
+	}
+	c := &policyCall{done: make(chan struct{})}
+	p.calls[key] = c
+	p.lock.Unlock()
+
+	select {
+	case p.procs <- struct{}{}:
+		c.verdict, c.err = p.run(key.client, name)
+		<-p.procs
+	default:
+		c.err = errPolicyBusy
+	}
+
+	p.lock.Lock()
+	delete(p.calls, key)
+	if c.err == nil {
+		p.cache[key] = policyDecision{verdict: c.verdict, expires: now.Add(p.cacheTTL)}
+	}
+	p.lock.Unlock()
+	close(c.done)
+	return c.verdict, c.err
+}
+
+// run runs the program in its own process group, so that on timeout its
+// children are killed too and do not keep stdout open. Names come from
+// clients, "--" keeps ones starting with "-" from being taken as options.
+func (p *externalPolicy) run(client, name string) (string, error) {
+	args := append(append([]string(nil), p.command[1:]...), "--", client, name)
+	cmd := exec.Command(p.command[0], args...)
+	cmd.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("external_policy: %w", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", fmt.Errorf("external_policy: %w", err)
+		}
+	case <-timer.C:
+		unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+		<-done
+		return "", fmt.Errorf("external_policy: timed out after %v", p.timeout)
+	}
+
+	switch verdict := strings.TrimSpace(stdout.String()); verdict {
+	case policyAllow, policyBlock, policyDefault:
+		return verdict, nil
+	default:
+		return "", fmt.Errorf("external_policy: unexpected output %q", verdict)
+	}
+}
+
+// cleanupLoop periodically removes expired verdicts.
+func (p *externalPolicy) cleanupLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		now := time.Now()
+		p.lock.Lock()
+		for key, d := range p.cache {
+			if !now.Before(d.expires) {
+				delete(p.cache, key)
+			}
+		}
+		p.lock.Unlock()
+	}
+}
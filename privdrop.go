@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// lookupIDs resolves the user and group names (or numeric IDs) from the
+// configuration. The user's primary group is used if groupName is empty.
+func lookupIDs(userName, groupName string) (uid, gid int, err error) {
+	lookupUser := user.Lookup
+	if isNumeric(userName) {
+		lookupUser = user.LookupId
+	}
+	// Errors from os/user already mention user or group.
+	u, err := lookupUser(userName)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user: %w", err)
+	}
+
+	gidStr := u.Gid
+	if groupName != "" {
+		lookupGroup := user.LookupGroup
+		if isNumeric(groupName) {
+			lookupGroup = user.LookupGroupId
+		}
+		g, err := lookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		gidStr = g.Gid
+	}
+	gid, err = strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("group: %w", err)
+	}
+	return uid, gid, nil
+}
+
+func isNumeric(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// dropPrivileges switches the process (all threads) to uid and gid,
+// supplementary groups are cleared. It returns an error unless the switch is
+// confirmed to be complete, i.e. root privileges cannot be regained.
+//
+// The syscall package is used since its wrappers apply the change to all
+// threads (Go 1.16+), unix.Setgroups only affects the calling one.
+func dropPrivileges(uid, gid int) error {
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+
+	if unix.Getuid() != uid || unix.Geteuid() != uid || unix.Getgid() != gid || unix.Getegid() != gid {
+		return fmt.Errorf("privileges were not dropped: uid %d, euid %d, gid %d, egid %d",
+			unix.Getuid(), unix.Geteuid(), unix.Getgid(), unix.Getegid())
+	}
+	if groups, err := unix.Getgroups(); err != nil || len(groups) != 1 || groups[0] != gid {
+		return fmt.Errorf("privileges were not dropped: supplementary groups %v", groups)
+	}
+	if uid != 0 && unix.Setuid(0) == nil {
+		return fmt.Errorf("privileges were not dropped: setuid(0) succeeded")
+	}
+	return nil
+}
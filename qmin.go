@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Upper bound for NS queries sent for one name, as MAX_MINIMISE_COUNT in
+// RFC 9156.
+const maxMinimiseCount = 10
+
+// exchangeMinimized resolves msg using QNAME minimization (RFC 7816): NS
+// queries are sent for each ancestor of the name starting from the top-level
+// domain before the full query. If an ancestor does not exist, its NXDOMAIN
+// response is returned (RFC 8020) and the full name is never sent.
+//
+// Downstreams are usually recursive resolvers, so this mostly limits what
+// they see for names under non-existent domains. Any unexpected response to
+// an NS query stops the walk and the full query is sent instead.
+func (s *Server) exchangeMinimized(v *view, msg *dns.Msg) (*dns.Msg, string, error) {
+	labels := dns.SplitDomainName(msg.Question[0].Name)
+
+	for i := len(labels) - 1; i >= 1 && len(labels)-i <= maxMinimiseCount; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		resp, name, err := s.exchangeNS(v, zone)
+		if err != nil {
+			break
+		}
+		if resp.Rcode == dns.RcodeNameError {
+			reply := resp.Copy()
+			reply.Id = msg.Id
+			reply.Question = msg.Question
+			return reply, name, nil
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			break
+		}
+	}
+
+	return s.exchange(v, msg)
+}
+
+// exchangeNS sends the NS query for zone, responses are cached like ones
+// for client queries.
+func (s *Server) exchangeNS(v *view, zone string) (*dns.Msg, string, error) {
+	key := s.cacheKey(v, normalize(zone), dns.TypeNS, dns.ClassINET)
+	if s.cache != nil {
+		// Stale responses are not worth it here, just refresh them.
+		cached, refresh := s.cache.get(key)
+		if refresh {
+			defer s.cache.refreshDone(key)
+		} else if cached != nil {
+			return cached, "", nil
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeNS)
+	resp, name, err := s.exchange(v, m)
+	if err != nil {
+		return nil, name, err
+	}
+	if s.cache != nil {
+		s.cache.put(key, resp)
+	}
+	return resp, name, nil
+}
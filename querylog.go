@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type queryLogEntry struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Blocked    bool      `json:"blocked"`
+	WouldBlock bool      `json:"would_block,omitempty"`
+	Cached     bool      `json:"cached,omitempty"`
+	Downstream string    `json:"downstream,omitempty"`
+	Rcode      string    `json:"rcode"`
+	LatencyMs  float64   `json:"latency_ms"`
+}
+
+// queryLogger writes one JSON object per query to a file. Writes are
+// buffered and flushed once per second.
+type queryLogger struct {
+	lock sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	enc  *json.Encoder
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newQueryLogger(path string) (*queryLogger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriterSize(f, 64*1024)
+	l := &queryLogger{
+		f:    f,
+		w:    w,
+		enc:  json.NewEncoder(w),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go l.flushLoop()
+	return l, nil
+}
+
+func (l *queryLogger) log(entry *queryLogEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.enc.Encode(entry); err != nil {
+		log.Println("Query log write failed:", err)
+	}
+}
+
+func (l *queryLogger) flush() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.w.Flush(); err != nil {
+		log.Println("Query log write failed:", err)
+	}
+}
+
+func (l *queryLogger) flushLoop() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.flush()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *queryLogger) Close() error {
+	close(l.stop)
+	<-l.done
+	l.flush()
+	return l.f.Close()
+}
+
+// rcodeWriter remembers the rcode of the response written to the client.
+type rcodeWriter struct {
+	dns.ResponseWriter
+	rcode int
+}
+
+func (w *rcodeWriter) WriteMsg(m *dns.Msg) error {
+	w.rcode = m.Rcode
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// randomizeCase returns a copy of msg with letters in the question name
+// randomly switched to upper or lower case ("0x20 encoding"). Downstreams
+// echo the name as is, so an off-path attacker has to guess the case too.
+func randomizeCase(msg *dns.Msg) *dns.Msg {
+	name := []byte(msg.Question[0].Name)
+	bits := make([]byte, (len(name)+7)/8)
+	if _, err := rand.Read(bits); err != nil {
+		panic(err)
+	}
+	for i, c := range name {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+			if bits[i/8]&(1<<uint(i%8)) != 0 {
+				name[i] = c | 0x20
+			} else {
+				name[i] = c &^ 0x20
+			}
+		}
+	}
+
+	randomized := msg.Copy()
+	randomized.Question[0].Name = string(name)
+	return randomized
+}
+
+// restoreCase checks that resp echoes the question name from sent (see
+// randomizeCase) exactly and replaces it with the name from msg in the
+// question and owner names of records.
+func restoreCase(msg, sent, resp *dns.Msg) error {
+	// checkResponse allows error responses without the question.
+	if len(resp.Question) == 0 {
+		return nil
+	}
+	name := sent.Question[0].Name
+	if resp.Question[0].Name != name {
+		return fmt.Errorf("%w: question name %s, expected %s (case randomization)", errBadResponse, resp.Question[0].Name, name)
+	}
+
+	resp.Question[0].Name = msg.Question[0].Name
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); strings.EqualFold(hdr.Name, name) {
+				hdr.Name = msg.Question[0].Name
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter implements a per-client token bucket.
+type rateLimiter struct {
+	lock    sync.Mutex
+	qps     float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+// newRateLimiter creates a limiter allowing qps queries per second with bursts
+// of up to burst queries. If burst is not set, it defaults to qps.
+func newRateLimiter(qps, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = qps
+	}
+	return &rateLimiter{
+		qps:     float64(qps),
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow reports whether the client is within its budget and takes one token
+// from its bucket if so.
+func (rl *rateLimiter) allow(ip net.IP) bool {
+	key := string(ip.To16())
+	now := time.Now()
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rl.qps
+		if b.tokens > rl.burst {
+			b.tokens = rl.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// cleanupLoop periodically removes buckets of clients that were idle long
+// enough for their bucket to refill completely.
+func (rl *rateLimiter) cleanupLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	idle := time.Duration(rl.burst / rl.qps * float64(time.Second))
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		now := time.Now()
+		rl.lock.Lock()
+		for key, b := range rl.buckets {
+			if now.Sub(b.last) > idle {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.lock.Unlock()
+	}
+}
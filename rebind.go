@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	rebindOff      = "off"
+	rebindStrip    = "strip"
+	rebindNXDOMAIN = "nxdomain"
+)
+
+func checkRebindMode(mode string) error {
+	switch mode {
+	case rebindOff, rebindStrip, rebindNXDOMAIN:
+		return nil
+	default:
+		return fmt.Errorf("unknown rebind_protection: %s", mode)
+	}
+}
+
+// privateNets are loopback, RFC 1918, link-local, unique local and
+// unspecified address ranges, public names should not resolve to them.
+var privateNets = func() []*net.IPNet {
+	nets, err := parseCIDRs([]string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	})
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}()
+
+// isPrivateAddr reports whether rr is an A or AAAA record with an address from
+// privateNets.
+func isPrivateAddr(rr dns.RR) bool {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return containsIP(privateNets, rr.A)
+	case *dns.AAAA:
+		return containsIP(privateNets, rr.AAAA)
+	}
+	return false
+}
+
+// rebindAllowed reports whether the normalized name or one of its parent
+// domains is in rebind_allowed_domains, or has a conditional forwarder.
+func (s *Server) rebindAllowed(v *view, name string) bool {
+	for parent := name; parent != ""; parent = parentDomain(parent) {
+		if _, ok := s.rebindAllowedDomains[parent]; ok {
+			return true
+		}
+	}
+	return s.forwarder(v, name) != nil
+}
+
+// filterRebind implements DNS rebinding protection for the downstream response
+// resp to m: private addresses are removed from it or it is replaced with
+// NXDOMAIN, depending on rebind_protection.
+func (s *Server) filterRebind(v *view, m, resp *dns.Msg) *dns.Msg {
+	private := false
+	for _, rr := range resp.Answer {
+		if isPrivateAddr(rr) {
+			private = true
+			break
+		}
+	}
+	if !private {
+		return resp
+	}
+	name := normalize(m.Question[0].Name)
+	if s.rebindAllowed(v, name) {
+		return resp
+	}
+
+	atomic.AddUint32(&s.rebindCnt, 1)
+	log.Printf("Private addresses in response for %s, possible DNS rebinding", name)
+
+	if s.rebindMode == rebindNXDOMAIN {
+		return s.nxdomainReply(m)
+	}
+	resp.Answer = removePrivateAddrs(resp.Answer)
+	resp.Extra = removePrivateAddrs(resp.Extra)
+	return resp
+}
+
+func removePrivateAddrs(rrs []dns.RR) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		if !isPrivateAddr(rr) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+func normalizeDomains(domains []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(domains))
+	for _, domain := range domains {
+		set[normalize(domain)] = struct{}{}
+	}
+	return set
+}
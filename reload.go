@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"reflect"
+	"time"
+)
+
+// setLists replaces global lists and lists of views, viewLists has an entry
+// for each view as returned by loadViewLists.
+func (s *Server) setLists(l *domainLists, viewLists []*domainLists) {
+	s.listsLock.Lock()
+	defer s.listsLock.Unlock()
+	s.lists = l
+	for i, v := range s.views {
+		v.lists = viewLists[i]
+	}
+}
+
+// categoryStates returns a copy of Server.disabledCategories, states of
+// categories changed at runtime included.
+func (s *Server) categoryStates() map[string]bool {
+	s.listsLock.RLock()
+	defer s.listsLock.RUnlock()
+	states := make(map[string]bool, len(s.disabledCategories))
+	for name, disabled := range s.disabledCategories {
+		states[name] = disabled
+	}
+	return states
+}
+
+func (s *Server) config() Config {
+	s.cfgLock.Lock()
+	defer s.cfgLock.Unlock()
+	return s.cfg
+}
+
+// reloadLists re-reads all lists and replaces the ones used by the
+// server. On failure the previous lists are kept.
+func (s *Server) reloadLists() error {
+	cfg := s.config()
+	l, err := loadLists(cfg, s.categoryStates())
+	if err != nil {
+		return err
+	}
+	if err := checkBlacklist(cfg, l); err != nil {
+		return err
+	}
+	viewLists, err := loadViewLists(s.views, cfg)
+	if err != nil {
+		return err
+	}
+	s.setLists(l, viewLists)
+	if s.blockHits != nil {
+		s.blockHits.reset()
+	}
+	log.Println("Reloaded lists, blocking", l.size(), "domains")
+	return nil
+}
+
+// reloadConfig applies the new configuration to the running server.
+//
+// Only list-related options are applied, changes to the listening address and
+// downstreams are logged and require a restart.
+func (s *Server) reloadConfig(cfg Config) error {
+	old := s.config()
+	if !reflect.DeepEqual(old.Listen, cfg.Listen) {
+		log.Println("Listen address changed, restart is required to apply it")
+	}
+	if !reflect.DeepEqual(old.Downstreams, cfg.Downstreams) {
+		log.Println("Downstreams changed, restart is required to apply them")
+	}
+	if !reflect.DeepEqual(old.Views, cfg.Views) {
+		log.Println("Views changed, restart is required to apply them")
+	}
+	if old.StrictIDNA != cfg.StrictIDNA {
+		log.Println("strict_idna changed, restart is required to apply it")
+	}
+	if old.TLSCert != cfg.TLSCert || old.TLSKey != cfg.TLSKey {
+		log.Println("TLS certificate paths changed, restart is required to apply them")
+	}
+	if s.certs != nil {
+		if err := s.certs.reload(); err != nil {
+			log.Println("Failed to reload TLS certificate, keeping the old one:", err)
+		}
+	}
+
+	s.cfgLock.Lock()
+	s.cfg = cfg
+	s.cfgLock.Unlock()
+
+	// Categories changed at runtime keep their state.
+	states := categoryStates(cfg.Categories)
+	s.listsLock.Lock()
+	for name := range states {
+		if disabled, ok := s.disabledCategories[name]; ok {
+			states[name] = disabled
+		}
+	}
+	s.disabledCategories = states
+	s.listsLock.Unlock()
+
+	return s.reloadLists()
+}
+
+// reloadLoop reloads lists every interval plus a random delay of up to
+// jitter, so rhole instances started at the same time do not fetch lists
+// from the same servers at the same time.
+func (s *Server) reloadLoop(interval, jitter time.Duration) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for {
+		delay := interval
+		if jitter > 0 {
+			delay += time.Duration(rnd.Int63n(int64(jitter) + 1))
+		}
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-timer.C:
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+
+		if err := s.reloadLists(); err != nil {
+			log.Println("List reload failed, keeping the old blacklist:", err)
+		}
+	}
+}
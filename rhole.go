@@ -1,100 +1,199 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/miekg/dns"
-	"golang.org/x/net/idna"
 	"golang.org/x/sys/unix"
 )
 
-type Config struct {
-	Listen                string   `toml:"listen"`
-	Downstreams           []string `toml:"downstreams"`
-	DownstreamTimeoutSecs int      `toml:"downstream_timeout_secs"`
-	Blacklists            []string `toml:"blacklists"`
-	Whitelists            []string `toml:"whitelists"`
-}
+type Server struct {
+	serverIndx uint32
 
-func normalize(domain string) string {
-	domain = strings.ToLower(domain)
-	domain = strings.TrimSuffix(domain, ".")
-	norm, err := idna.ToASCII(domain)
-	if err != nil {
-		return domain
-	}
-	return norm
-}
+	blockedCnt       uint32
+	totalCnt         uint32
+	downstreamErrCnt uint32
+	cacheHitCnt      uint32
+	cacheMissCnt     uint32
+	staleHitCnt      uint32
+	inflightCnt      uint32
+	qtypeBlockedCnt  uint32
+	rateLimitedCnt   uint32
+	retryCnt         uint32
+	invalidTLDCnt    uint32
+	rebindCnt        uint32
+	// Exchanges not started because of max_inflight_downstream.
+	inflightLimitedCnt uint32
+	// Failed or not started (see errPolicyBusy) external_policy invocations,
+	// the lists were used instead.
+	externalPolicyErrCnt uint32
+	// Query names that failed IDNA conversion.
+	idnaErrCnt uint32
 
-func readLists(paths []string) (map[string]struct{}, error) {
-	list := make(map[string]struct{}, 50000)
+	downstreamLatency *histogram
+	queryLog          *queryLogger
+	startTime         time.Time
+	// Most frequently blocked names, nil if disabled.
+	blockHits *hitCounter
+	// Counters as of the previous logStats call, used only by it.
+	lastStats statsSnapshot
 
-	for _, path := range paths {
-		file, err := os.Open(path)
-		if err != nil {
-			return nil, err
-		}
-		defer file.Close()
+	httpMuxes   map[string]*http.ServeMux
+	httpsAddrs  map[string]bool
+	httpServers []*http.Server
+	controlL    net.Listener
 
-		scnr := bufio.NewScanner(file)
-		hosts := false
-		for scnr.Scan() {
-			//if strings.HasPrefix(scnr.Text(), "127.0.0.1 ") && !hosts {
-			//	fmt.Fprintf(os.Stderr, "%s detected as a hosts-style list, ignoring IP and blocking all domains\n", path)
-			//	hosts = true
-			//}
+	servers []*dns.Server
+	// nil if dnscrypt_listen is not set.
+	dnscrypt *dnscryptServer
 
-			line := scnr.Text()
-			if indx := strings.Index(line, "#"); indx != -1 {
-				line = line[:indx]
-			}
-			parts := strings.Fields(line)
+	listsLock sync.RWMutex
+	lists     *domainLists
+	// Set using the control socket, kept across list reloads.
+	overrides map[string]bool
+	// Category name -> whether it is disabled, initially set from the
+	// configuration and changed using the control socket.
+	disabledCategories map[string]bool
 
-			if hosts {
-				if len(parts) == 0 { // empty line
-					continue
-				}
-				parts = parts[1:]
-			}
+	// Checked in order, the first one containing the client is used.
+	views []*view
 
-			for _, part := range parts {
-				list[normalize(part)] = struct{}{}
-			}
-		}
-		if err := scnr.Err(); err != nil {
-			return nil, err
-		}
-	}
+	downstreams []*downstream
+	timeout     time.Duration
+	parallel    int
+	retries     int
+	// Indexes of downstreams in round-robin order, see weightedSchedule.
+	schedule []int
+	// Semaphore for max_inflight_downstream, nil if unlimited.
+	exchangeSlots chan struct{}
+	// Whether health checks run, so downstreams marked as down come back.
+	healthChecks bool
 
-	return list, nil
-}
+	qnameMinimization bool
+	// Randomize case of names sent to plain DNS downstreams, see
+	// randomizeCase.
+	caseRandomization bool
 
-type Server struct {
-	serverIndx uint32
+	ednsUDPSize uint16
+	ecsMode     string
+	ecsPrefixV4 uint8
+	ecsPrefixV6 uint8
+	// Upper bound for UDP responses on top of the client's buffer size.
+	maxUDPResponse int
+	// How queries are answered until lists are loaded, see startupReply.
+	startupMode string
+
+	// Answers for version.bind and hostname.bind, see chaosReply.
+	chaosVersion  string
+	chaosHostname string
+
+	cache     *responseCache
+	cacheFile string
+	blockTTL  uint32
+	blockSOA  BlockSOAConfig
+	anyMode   string
+
+	blockSubdomains bool
+	blockQtypes     map[uint16]struct{}
+	// Global block policy, views may have their own, see policyFor.
+	policy blockPolicy
+	// Only log blacklisted names instead of blocking them.
+	monitorMode bool
+	// Block all names except for whitelisted ones, see isBlocked.
+	allowlistMode bool
+	// Log names failing IDNA conversion, see setStrictIDNA.
+	strictIDNA bool
+	idnaLog    *logLimiter
+	// Also block responses with blacklisted CNAME targets.
+	cnameUncloaking bool
+	// Reverse names of addresses used in synthesized answers.
+	sinkholePTR map[string]struct{}
+	// Answer PTR queries for private addresses with NXDOMAIN.
+	blockPrivatePTR bool
+	// If false, queries that are not answered locally are refused instead of
+	// being forwarded and the RA bit is not set.
+	recursion bool
+	// Remove DNSSEC records from responses to queries without the DO bit.
+	stripDNSSEC bool
+	// Set if valid_tlds is, see invalidTLDReply.
+	validTLDs map[string]struct{}
+	// See filterRebind.
+	rebindMode           string
+	rebindAllowedDomains map[string]struct{}
+	// Certificate for DoT and DoH listeners, nil if not configured.
+	certs *certReloader
+	// Socket buffer sizes for UDP listeners, 0 to use system defaults.
+	udpReadBuffer  int
+	udpWriteBuffer int
+	// Limits for TTLs in downstream responses, see clampTTLs.
+	minTTL uint32
+	maxTTL uint32
 
-	blockedCnt uint32
-	totalCnt   uint32
+	allowedClients []*net.IPNet
+	rateLimit      *rateLimiter
 
-	s           *dns.Server
-	cl          dns.Client
-	blacklist   map[string]struct{}
-	downstreams []string
+	externalPolicy *externalPolicy
+	// Thresholds of downstream circuit breakers, nil if disabled.
+	breaker *breakerConfig
+
+	local *localRecords
+
+	validator *validator
+
+	stop chan struct{}
+
+	closingLock sync.RWMutex
+	closing     bool
+	inflight    sync.WaitGroup
+
+	// Configuration used to (re)load lists, protected by cfgLock.
+	cfgLock sync.Mutex
+	cfg     Config
 }
 
 func (s *Server) ServeDNS(w dns.ResponseWriter, m *dns.Msg) {
+	if !s.startQuery() {
+		return
+	}
+	defer s.finishQuery()
+
+	var ql *queryLogEntry
+	if s.queryLog != nil {
+		ql = &queryLogEntry{Time: time.Now()}
+		if ip := remoteIP(w.RemoteAddr()); ip != nil {
+			ql.Client = ip.String()
+		}
+		rw := &rcodeWriter{ResponseWriter: w, rcode: -1}
+		w = rw
+		defer func() {
+			if len(m.Question) != 0 {
+				ql.Name = m.Question[0].Name
+				ql.Type = dns.TypeToString[m.Question[0].Qtype]
+			}
+			ql.Rcode = dns.RcodeToString[rw.rcode]
+			ql.LatencyMs = float64(time.Since(ql.Time)) / float64(time.Millisecond)
+			s.queryLog.log(ql)
+		}()
+	}
+
+	w = &ednsWriter{ResponseWriter: w, req: m, udpSize: s.ednsUDPSize, maxUDP: s.maxUDPResponse}
+
 	reply := new(dns.Msg)
 
-	if m.MsgHdr.Opcode != dns.OpcodeQuery {
+	if !s.clientAllowed(w.RemoteAddr()) {
 		reply.SetRcode(m, dns.RcodeRefused)
 		if err := w.WriteMsg(reply); err != nil {
 			log.Printf("WriteMsg: %v", err)
@@ -102,11 +201,47 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, m *dns.Msg) {
 		return
 	}
 
+	if s.rateLimit != nil {
+		if ip := remoteIP(w.RemoteAddr()); ip != nil && !s.rateLimit.allow(ip) {
+			atomic.AddUint32(&s.rateLimitedCnt, 1)
+			return
+		}
+	}
+
+	v := s.viewFor(w.RemoteAddr())
+
+	if m.MsgHdr.Opcode != dns.OpcodeQuery {
+		rcode := opcodeRcode(m.MsgHdr.Opcode)
+		log.Printf("Rejecting %s from %v with %s", dns.OpcodeToString[m.MsgHdr.Opcode], w.RemoteAddr(), dns.RcodeToString[rcode])
+		reply.SetRcode(m, rcode)
+		if err := w.WriteMsg(reply); err != nil {
+			log.Printf("WriteMsg: %v", err)
+		}
+		return
+	}
+
+	// Normally rejected by dns.DefaultMsgAcceptFunc already, but ServeDNS
+	// must not depend on that.
+	if len(m.Question) != 1 {
+		reply.SetRcode(m, dns.RcodeFormatError)
+		if err := w.WriteMsg(reply); err != nil {
+			log.Printf("WriteMsg: %v", err)
+		}
+		return
+	}
+
 	reply.SetReply(m)
-	reply.RecursionAvailable = true
+	reply.RecursionAvailable = s.recursion
 
 	q := m.Question[0]
 
+	if reply := s.chaosReply(m); reply != nil {
+		if err := w.WriteMsg(reply); err != nil {
+			log.Printf("WriteMsg: %v", err)
+		}
+		return
+	}
+
 	if q.Qclass != dns.ClassINET {
 		reply.SetRcode(m, dns.RcodeNotImplemented)
 		if err := w.WriteMsg(reply); err != nil {
@@ -117,37 +252,99 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, m *dns.Msg) {
 
 	atomic.AddUint32(&s.totalCnt, 1)
 
-	key := normalize(q.Name)
-	if _, ok := s.blacklist[key]; ok {
-		// Synthesize NXDOMAIN.
-		reply.Rcode = dns.RcodeNameError
-		reply.RecursionAvailable = true
-		reply.Ns = []dns.RR{
-			&dns.SOA{
-				Hdr: dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeSOA,
-					Class:  dns.ClassINET,
-					Ttl:    9999,
-				},
-				Ns:      "invalid.",
-				Mbox:    "hostmaster.invalid.",
-				Serial:  1,
-				Refresh: 900,
-				Retry:   900,
-				Expire:  1800,
-				Minttl:  60,
-			},
-		}
-		atomic.AddUint32(&s.blockedCnt, 1)
+	if q.Qtype == dns.TypeANY {
+		if reply := s.anyReply(m); reply != nil {
+			if err := w.WriteMsg(reply); err != nil {
+				log.Printf("WriteMsg: %v", err)
+			}
+			return
+		}
+	}
+
+	if _, ok := s.blockQtypes[q.Qtype]; ok {
+		atomic.AddUint32(&s.qtypeBlockedCnt, 1)
+		if err := w.WriteMsg(s.nodataReply(m)); err != nil {
+			log.Printf("WriteMsg: %v", err)
+		}
+		return
+	}
+
+	key, err := normalizeErr(q.Name)
+	if err != nil {
+		atomic.AddUint32(&s.idnaErrCnt, 1)
+		if s.strictIDNA {
+			s.idnaLog.printf("Debug: IDNA conversion of %s from %v failed: %v", q.Name, w.RemoteAddr(), err)
+		}
+	}
+
+	if local := s.localReply(m, key); local != nil {
+		if err := w.WriteMsg(local); err != nil {
+			log.Printf("WriteMsg: %v", err)
+		}
+		return
+	}
+	if reply := s.ptrReply(m, key); reply != nil {
+		if err := w.WriteMsg(reply); err != nil {
+			log.Printf("WriteMsg: %v", err)
+		}
+		return
+	}
+	if reply := s.invalidTLDReply(v, m, key); reply != nil {
+		if err := w.WriteMsg(reply); err != nil {
+			log.Printf("WriteMsg: %v", err)
+		}
+		return
+	}
+
+	if s.startupReply(v, w, m, ql, key) {
+		return
+	}
+	if s.blockedFor(v, remoteIP(w.RemoteAddr()), key) && s.block(v, w, m, ql, key) {
+		return
+	}
 
+	if !s.recursion {
+		reply.SetRcode(m, dns.RcodeRefused)
 		if err := w.WriteMsg(reply); err != nil {
 			log.Printf("WriteMsg: %v", err)
 		}
 		return
 	}
 
-	downReply, err := s.exchange(m)
+	query, ecs := s.ecsQuery(m, remoteIP(w.RemoteAddr()))
+	cKey := s.cacheKey(v, key, q.Qtype, q.Qclass)
+	cKey.ecs = ecs
+	cKey.cd = m.CheckingDisabled
+	if opt := m.IsEdns0(); opt != nil {
+		cKey.do = opt.Do()
+	}
+	if s.cache != nil {
+		if cached, refresh := s.cache.get(cKey); cached != nil {
+			atomic.AddUint32(&s.cacheHitCnt, 1)
+			if refresh {
+				atomic.AddUint32(&s.staleHitCnt, 1)
+				go s.refreshCached(v, m.Copy(), query.Copy(), cKey)
+			}
+			if ql != nil {
+				ql.Cached = true
+			}
+			if target := s.cloakedTarget(v, cached); target != "" && s.block(v, w, m, ql, target) {
+				return
+			}
+			cached.Id = m.Id
+			cached.Question = m.Question
+			if err := w.WriteMsg(cached); err != nil {
+				log.Printf("WriteMsg: %v", err)
+			}
+			return
+		}
+		atomic.AddUint32(&s.cacheMissCnt, 1)
+	}
+
+	downReply, downstream, err := s.resolve(v, m, query)
+	if ql != nil {
+		ql.Downstream = downstream
+	}
 	if err != nil {
 		log.Println("Downstream error:", err)
 		reply.SetRcode(m, dns.RcodeServerFailure)
@@ -156,30 +353,254 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, m *dns.Msg) {
 		}
 		return
 	}
+	if s.cache != nil {
+		s.cache.put(cKey, downReply)
+	}
+	if target := s.cloakedTarget(v, downReply); target != "" && s.block(v, w, m, ql, target) {
+		return
+	}
 	if err := w.WriteMsg(downReply); err != nil {
 		log.Printf("WriteMsg: %v", err)
 	}
 }
 
+// resolve sends query (m as modified by ecsQuery) to downstreams of view v
+// and validates the response.
+func (s *Server) resolve(v *view, m, query *dns.Msg) (*dns.Msg, string, error) {
+	var (
+		resp       *dns.Msg
+		downstream string
+		err        error
+	)
+	if s.qnameMinimization {
+		resp, downstream, err = s.exchangeMinimized(v, query)
+	} else {
+		resp, downstream, err = s.exchange(v, query)
+	}
+	if err != nil {
+		return nil, downstream, err
+	}
+	if s.validator != nil {
+		resp = s.validateReply(m, resp)
+	}
+	if s.rebindMode != rebindOff {
+		resp = s.filterRebind(v, m, resp)
+	}
+	if s.stripDNSSEC {
+		if opt := m.IsEdns0(); opt == nil || !opt.Do() {
+			stripDNSSEC(resp)
+		}
+	}
+	if s.minTTL != 0 || s.maxTTL != 0 {
+		clampTTLs(resp, s.minTTL, s.maxTTL)
+	}
+	return resp, downstream, nil
+}
+
+// refreshCached replaces the stale cache entry for key with a new response.
+// Failures, including SERVFAIL and REFUSED responses, keep the stale entry,
+// so it can be served until max_stale_secs passes.
+func (s *Server) refreshCached(v *view, m, query *dns.Msg, key cacheKey) {
+	defer s.cache.refreshDone(key)
+
+	resp, _, err := s.resolve(v, m, query)
+	if err == nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		err = fmt.Errorf("%s response", dns.RcodeToString[resp.Rcode])
+	}
+	if err != nil {
+		log.Printf("Failed to refresh %s: %v", m.Question[0].Name, err)
+		return
+	}
+	s.cache.put(key, resp)
+}
+
+// opcodeRcode returns the rcode used to reject requests with opcodes other
+// than QUERY. We are not authoritative for anything, so updates are refused
+// and other opcodes are not implemented.
+func opcodeRcode(opcode int) int {
+	switch opcode {
+	case dns.OpcodeUpdate:
+		return dns.RcodeRefused
+	default:
+		return dns.RcodeNotImplemented
+	}
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}
+
 func isLoopback(addr string) bool {
-	ip := net.ParseIP(addr)
+	ip, _ := splitZone(addr)
 	if ip == nil {
 		return false
 	}
 	return ip.IsLoopback()
 }
 
-func (s *Server) exchange(msg *dns.Msg) (*dns.Msg, error) {
-	offset := int(atomic.AddUint32(&s.serverIndx, 1) % uint32(len(s.downstreams)))
+// nextDownstream returns the index of the downstream to use next according
+// to the weighted round-robin schedule.
+func (s *Server) nextDownstream(schedule []int) int {
+	offset := int(atomic.AddUint32(&s.serverIndx, 1) % uint32(len(schedule)))
 	if offset < 0 { // attempt to deal with integer overflows on 32-bit platforms
-		offset = (-offset) % len(s.downstreams)
+		offset = (-offset) % len(schedule)
 	}
-	downstream := s.downstreams[offset]
+	return schedule[offset]
+}
 
-	resp, _, err := s.cl.Exchange(msg, net.JoinHostPort(downstream, "53"))
+// pickDownstreams returns count downstreams of view v to use for the next
+// query.
+//
+// Downstreams marked as down by the health checker or with an open circuit
+// are skipped unless all of them are.
+func (s *Server) pickDownstreams(v *view, count int) []*downstream {
+	downstreams, schedule := s.downstreamsFor(v)
+	offset := s.nextDownstream(schedule)
+	now := time.Now()
+	picked := make([]*downstream, 0, count)
+	for i := 0; i < len(downstreams) && len(picked) < count; i++ {
+		d := downstreams[(offset+i)%len(downstreams)]
+		if d.isUp() && (s.breaker == nil || d.breaker.available(now)) {
+			picked = append(picked, d)
+		}
+	}
+	if len(picked) == 0 {
+		for i := 0; i < count; i++ {
+			picked = append(picked, downstreams[(offset+i)%len(downstreams)])
+		}
+	}
+	return picked
+}
+
+// exchange forwards msg to the downstreams of view v (nil for global ones)
+// and returns the response along with the downstream that provided it.
+//
+// Failed exchanges are retried up to s.retries times using the next
+// downstream, all attempts together are bounded by s.timeout. Downstreams
+// refusing connections or unreachable and ones with an open circuit (see
+// circuitBreaker) are skipped without using up a retry.
+func (s *Server) exchange(v *view, msg *dns.Msg) (*dns.Msg, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if d := s.forwarder(v, msg.Question[0].Name); d != nil {
+		resp, err := s.exchangeWith(ctx, d, msg)
+		return resp, d.name, err
+	}
+
+	// Retries go to the next downstream in the list rather than to the next
+	// one in the schedule, which may be the same for weighted downstreams.
+	var candidates []*downstream
+	retries, skipped := 0, 0
+	for attempt := 0; ; attempt++ {
+		var (
+			resp *dns.Msg
+			name string
+			err  error
+		)
+		downstreams, _ := s.downstreamsFor(v)
+		if s.parallel > 1 && len(downstreams) > 1 {
+			resp, name, err = s.exchangeParallel(ctx, v, msg)
+		} else {
+			if candidates == nil {
+				candidates = s.pickDownstreams(v, len(downstreams))
+			}
+			d := candidates[attempt%len(candidates)]
+			resp, err = s.exchangeWith(ctx, d, msg)
+			name = d.name
+		}
+		if err == nil || ctx.Err() != nil || errors.Is(err, errTooManyInflight) {
+			return resp, name, err
+		}
+		if (isHardDown(err) || errors.Is(err, errCircuitOpen)) && skipped < len(candidates)-1 {
+			skipped++
+			continue
+		}
+		if retries >= s.retries {
+			return resp, name, err
+		}
+		retries++
+		atomic.AddUint32(&s.retryCnt, 1)
+	}
+}
+
+// How long an exchange waits for a free slot if max_inflight_downstream
+// exchanges are already running.
+const inflightWait = 100 * time.Millisecond
+
+var errTooManyInflight = errors.New("too many downstream exchanges in flight")
+
+// acquireExchange waits for a slot for a downstream exchange, release must be
+// called after it completes.
+func (s *Server) acquireExchange(ctx context.Context) (release func(), err error) {
+	if s.exchangeSlots == nil {
+		return func() {}, nil
+	}
+	release = func() { <-s.exchangeSlots }
+
+	select {
+	case s.exchangeSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	timer := time.NewTimer(inflightWait)
+	defer timer.Stop()
+	select {
+	case s.exchangeSlots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	atomic.AddUint32(&s.inflightLimitedCnt, 1)
+	return nil, errTooManyInflight
+}
+
+func (s *Server) exchangeWith(ctx context.Context, d *downstream, msg *dns.Msg) (*dns.Msg, error) {
+	release, err := s.acquireExchange(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
+
+	if s.breaker != nil {
+		if !d.breaker.allow(time.Now()) {
+			return nil, fmt.Errorf("%s: %w", d.name, errCircuitOpen)
+		}
+	}
+
+	// Encrypted channels do not need it and DNS-over-HTTPS servers may
+	// normalize the name.
+	sent := msg
+	if tr := d.transport(); s.caseRandomization && (tr == "udp" || tr == "tcp") {
+		sent = randomizeCase(msg)
+	}
+
+	atomic.AddUint32(&d.queries, 1)
+	start := time.Now()
+	resp, err := d.exchange(ctx, sent)
+	if err == nil && sent != msg {
+		if err = restoreCase(msg, sent, resp); err != nil {
+			err = fmt.Errorf("%s: %w", d.name, err)
+		}
+	}
+	if s.breaker != nil {
+		s.recordExchange(d, resp, err)
+	}
+	if err != nil {
+		s.countError(d, err)
+		return nil, err
+	}
+	rtt := time.Since(start)
+	s.downstreamLatency.observe(rtt)
+	d.rtt.observe(rtt)
 
 	if resp.Rcode != dns.RcodeSuccess {
 		return resp, nil
@@ -188,108 +609,603 @@ func (s *Server) exchange(msg *dns.Msg) (*dns.Msg, error) {
 	// Diregard AD flags from non-local resolvers, likely they are
 	// communicated with using an insecure channel and so flags can be
 	// tampered with.
-	if !isLoopback(downstream) {
+	if !d.secure {
 		resp.AuthenticatedData = false
 	}
 
 	return resp, nil
 }
 
-func NewServer(listen string, blacklist map[string]struct{}, downstreams []string, timeout time.Duration) (*Server, error) {
-	tcpL, err := net.Listen("tcp", listen)
+// exchangeParallel sends msg to several downstreams at once and returns the
+// first NOERROR or NXDOMAIN response. If there is none, other response or
+// error is returned.
+func (s *Server) exchangeParallel(ctx context.Context, v *view, msg *dns.Msg) (*dns.Msg, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		d    *downstream
+		resp *dns.Msg
+		err  error
+	}
+
+	downstreams, _ := s.downstreamsFor(v)
+	count := s.parallel
+	if count > len(downstreams) {
+		count = len(downstreams)
+	}
+	picked := s.pickDownstreams(v, count)
+	results := make(chan result, len(picked))
+	for _, d := range picked {
+		d := d
+		go func() {
+			resp, err := s.exchangeWith(ctx, d, msg.Copy())
+			results <- result{d: d, resp: resp, err: err}
+		}()
+	}
+
+	var fallback result
+	for range picked {
+		var res result
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			if fallback.d == nil {
+				return nil, "", ctx.Err()
+			}
+			return fallback.resp, fallback.d.name, fallback.err
+		}
+
+		if res.err == nil && (res.resp.Rcode == dns.RcodeSuccess || res.resp.Rcode == dns.RcodeNameError) {
+			return res.resp, res.d.name, nil
+		}
+		// Prefer an actual response (SERVFAIL, REFUSED, etc) to a network
+		// error.
+		if fallback.d == nil || (fallback.err != nil && res.err == nil) {
+			fallback = res
+		}
+	}
+
+	return fallback.resp, fallback.d.name, fallback.err
+}
+
+func NewServer(cfg Config, lists *domainLists) (*Server, error) {
+	sinkholeV4, err := parseSinkhole(cfg.SinkholeIPv4, false)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("sinkhole_ipv4: %w", err)
+	}
+	sinkholeV6, err := parseSinkhole(cfg.SinkholeIPv6, true)
+	if err != nil {
+		return nil, fmt.Errorf("sinkhole_ipv6: %w", err)
+	}
+
+	timeout := time.Duration(cfg.DownstreamTimeoutSecs) * time.Second
+	timeouts := configTimeouts(cfg)
+	downstreams := make([]*downstream, 0, len(cfg.Downstreams))
+	for _, entry := range cfg.Downstreams {
+		addr, weight, err := splitWeight(entry)
+		if err != nil {
+			return nil, err
+		}
+		d, err := parseDownstream(addr, cfg.DownstreamNet, timeouts)
+		if err != nil {
+			return nil, err
+		}
+		d.weight = weight
+		downstreams = append(downstreams, d)
 	}
-	udpL, err := net.ListenPacket("udp", listen)
+
+	blockQtypes, err := parseQtypes(cfg.BlockQtypes)
+	if err != nil {
+		return nil, fmt.Errorf("block_qtypes: %w", err)
+	}
+
+	allowedClients, err := parseCIDRs(cfg.AllowedClients)
+	if err != nil {
+		return nil, fmt.Errorf("allowed_clients: %w", err)
+	}
+
+	views, err := newViews(cfg, timeouts)
 	if err != nil {
 		return nil, err
 	}
+	// Without global lists, view lists are loaded later along with them,
+	// see loadInitialLists.
+	viewLists := make([]*domainLists, len(views))
+	if lists != nil {
+		viewLists, err = loadViewLists(views, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, v := range views {
+		v.lists = viewLists[i]
+		if v.lists != nil {
+			log.Printf("View %s: blocking %d domains", v.name, v.lists.size())
+		}
+	}
 
 	srv := &Server{
-		cl: dns.Client{
-			Timeout: timeout,
-		},
-		blacklist:   blacklist,
+		lists:       lists,
+		views:       views,
+		overrides:   make(map[string]bool),
 		downstreams: downstreams,
+		schedule:    weightedSchedule(downstreams),
+		timeout:     timeout,
+		parallel:    cfg.ParallelDownstreams,
+		retries:     cfg.DownstreamRetries,
+		ednsUDPSize: uint16(cfg.EDNSUDPSize),
+		ecsMode:     cfg.ECSMode,
+		ecsPrefixV4: uint8(cfg.ECSPrefixV4),
+		ecsPrefixV6: uint8(cfg.ECSPrefixV6),
+		blockTTL:    cfg.BlockTTL,
+		blockSOA:    cfg.BlockSOA,
+		anyMode:     cfg.AnyQueryMode,
+		stop:        make(chan struct{}),
+		cfg:         cfg,
+
+		blockSubdomains:   cfg.BlockSubdomains,
+		chaosVersion:      cfg.ChaosVersion,
+		chaosHostname:     cfg.ChaosHostname,
+		monitorMode:       cfg.MonitorMode,
+		cnameUncloaking:   cfg.CNAMEUncloaking,
+		blockQtypes:       blockQtypes,
+		blockPrivatePTR:   cfg.BlockPrivatePTR,
+		recursion:         cfg.Recursion,
+		stripDNSSEC:       cfg.StripDNSSECForClients,
+		rebindMode:        cfg.RebindProtection,
+		udpReadBuffer:     cfg.UDPReadBuffer,
+		udpWriteBuffer:    cfg.UDPWriteBuffer,
+		minTTL:            cfg.MinTTL,
+		maxTTL:            cfg.MaxTTL,
+		qnameMinimization: cfg.QnameMinimization,
+		caseRandomization: cfg.CaseRandomization,
+		allowedClients:    allowedClients,
+		downstreamLatency: newHistogram(),
+		startTime:         time.Now(),
+		httpMuxes:         make(map[string]*http.ServeMux),
+		httpsAddrs:        make(map[string]bool),
+	}
+	srv.policy = blockPolicy{
+		mode:       cfg.BlockMode,
+		sinkholeV4: sinkholeV4,
+		sinkholeV6: sinkholeV6,
+		cname:      normalize(cfg.BlockCNAME),
+	}
+	policies := []*blockPolicy{&srv.policy}
+	for _, v := range views {
+		if v.block != nil {
+			policies = append(policies, v.block)
+		}
+	}
+	srv.sinkholePTR = sinkholeNames(policies...)
+	srv.healthChecks = cfg.HealthCheckIntervalSecs != 0
+	srv.allowlistMode = cfg.Mode == modeAllowlist
+	srv.strictIDNA = cfg.StrictIDNA
+	srv.idnaLog = &logLimiter{interval: 10 * time.Second}
+	if cfg.CircuitBreakerErrorPercent > 0 {
+		srv.breaker = &breakerConfig{
+			errorPercent: cfg.CircuitBreakerErrorPercent,
+			window:       cfg.CircuitBreakerWindow,
+			cooldown:     time.Duration(cfg.CircuitBreakerCooldownSecs) * time.Second,
+		}
+	}
+	srv.maxUDPResponse = cfg.MaxUDPResponse
+	srv.startupMode = cfg.StartupMode
+	if cfg.MaxInflightDownstream > 0 {
+		srv.exchangeSlots = make(chan struct{}, cfg.MaxInflightDownstream)
+	}
+	if cfg.BlockStatsSize > 0 {
+		srv.blockHits = newHitCounter(cfg.BlockStatsSize)
+	}
+	if cfg.ClientQPS > 0 {
+		srv.rateLimit = newRateLimiter(cfg.ClientQPS, cfg.ClientBurst)
+		go srv.rateLimit.cleanupLoop(srv.stop)
+	}
+	if len(cfg.ExternalPolicy) != 0 {
+		srv.externalPolicy = newExternalPolicy(cfg.ExternalPolicy,
+			time.Duration(cfg.ExternalPolicyTimeoutMs)*time.Millisecond,
+			time.Duration(cfg.ExternalPolicyCacheSecs)*time.Second,
+			cfg.ExternalPolicyMaxProcs)
+		go srv.externalPolicy.cleanupLoop(srv.stop)
+	}
+	if len(cfg.LocalRecords) != 0 {
+		srv.local, err = newLocalRecords(cfg.LocalRecords, cfg.LocalTTL, cfg.LocalPTR)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ValidTLDs != "" {
+		srv.validTLDs, err = loadTLDs(cfg.ValidTLDs, cfg.InternalTLDs, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("valid_tlds: %w", err)
+		}
+	}
+	if cfg.ValidateDNSSEC {
+		srv.validator, err = newValidator(cfg.DNSSECTrustAnchors, func(m *dns.Msg) (*dns.Msg, error) {
+			resp, _, err := srv.exchange(nil, m)
+			return resp, err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("dnssec_trust_anchors: %w", err)
+		}
+	}
+	srv.disabledCategories = categoryStates(cfg.Categories)
+	srv.rebindAllowedDomains = normalizeDomains(cfg.RebindAllowedDomains)
+	if cfg.CacheSize > 0 {
+		srv.cache = newResponseCache(cfg.CacheSize, time.Duration(cfg.NegativeCacheSecs)*time.Second,
+			time.Duration(cfg.MaxStaleSecs)*time.Second)
+		srv.cacheFile = cfg.CacheFile
+	}
+	if srv.cacheFile != "" {
+		n, err := srv.cache.load(srv.cacheFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("Ignoring saved cache:", err)
+		} else if err == nil {
+			log.Println("Loaded", n, "cached responses from", srv.cacheFile)
+		}
+	}
+	if cfg.QueryLog != "" {
+		srv.queryLog, err = newQueryLogger(cfg.QueryLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ControlSocket != "" {
+		if err := srv.listenControl(cfg.ControlSocket); err != nil {
+			return nil, fmt.Errorf("control_socket: %w", err)
+		}
+	}
+	if cfg.MetricsListen != "" {
+		if err := srv.handleHTTP(cfg.MetricsListen, "/metrics", srv.serveMetrics, nil); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.StatsListen != "" {
+		if err := srv.handleHTTP(localhostAddr(cfg.StatsListen), "/stats", srv.serveStats, nil); err != nil {
+			return nil, err
+		}
+	}
+	var probeAddrs []string
+	if cfg.MetricsListen != "" {
+		probeAddrs = append(probeAddrs, cfg.MetricsListen)
+	}
+	if cfg.StatsListen != "" && localhostAddr(cfg.StatsListen) != cfg.MetricsListen {
+		probeAddrs = append(probeAddrs, localhostAddr(cfg.StatsListen))
+	}
+	for _, addr := range probeAddrs {
+		if err := srv.handleHTTP(addr, "/healthz", srv.serveHealthz, nil); err != nil {
+			return nil, err
+		}
+		if err := srv.handleHTTP(addr, "/readyz", srv.serveReadyz, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		srv.certs, err = newCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("tls_cert: %w", err)
+		}
+		tlsConfig = &tls.Config{
+			GetCertificate: srv.certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+	if cfg.DoHListen != "" {
+		if err := srv.handleHTTP(cfg.DoHListen, "/dns-query", srv.serveDoH, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+	reusePort := cfg.ReusePort || cfg.Listeners > 1
+	for _, addr := range cfg.Listen {
+		if addr == listenSystemd {
+			if err := srv.listenSystemd(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		for i := 0; i < cfg.Listeners; i++ {
+			if err := srv.listen(addr, reusePort); err != nil {
+				return nil, err
+			}
+		}
 	}
-	srv.s = &dns.Server{
-		Listener:   tcpL,
-		PacketConn: udpL,
-		Handler:    srv,
+	if len(cfg.TLSListen) != 0 {
+		if tlsConfig == nil {
+			return nil, fmt.Errorf("tls_cert and tls_key are required for tls_listen")
+		}
+		for _, addr := range cfg.TLSListen {
+			if err := srv.listenTLS(addr, reusePort, tlsConfig); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(cfg.DNSCryptListen) != 0 {
+		srv.dnscrypt, err = newDNSCrypt(srv, cfg.DNSCryptProviderName, cfg.DNSCryptKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range cfg.DNSCryptListen {
+			if err := srv.dnscrypt.listen(addr, reusePort); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return srv, nil
 }
 
+// Serve runs all DNS servers and blocks until they are stopped.
 func (s *Server) Serve() {
-	s.s.ActivateAndServe()
+	var wg sync.WaitGroup
+	for _, dnsSrv := range s.servers {
+		wg.Add(1)
+		go func(dnsSrv *dns.Server) {
+			defer wg.Done()
+			if err := dnsSrv.ActivateAndServe(); err != nil {
+				log.Println("Server failed:", err)
+			}
+		}(dnsSrv)
+	}
+	if s.dnscrypt != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.dnscrypt.serve()
+		}()
+	}
+	wg.Wait()
 }
 
-func (s *Server) Close() {
-	s.s.Shutdown()
+// startQuery registers an in-flight query. It returns false if the server
+// is shutting down and the query should be dropped.
+func (s *Server) startQuery() bool {
+	s.closingLock.RLock()
+	defer s.closingLock.RUnlock()
+	if s.closing {
+		return false
+	}
+	s.inflight.Add(1)
+	atomic.AddUint32(&s.inflightCnt, 1)
+	return true
 }
 
-func main() {
-	cfgPath := "/etc/rhole.toml"
-	switch len(os.Args) {
-	case 1:
-	case 2:
-		cfgPath = os.Args[1]
+func (s *Server) finishQuery() {
+	atomic.AddUint32(&s.inflightCnt, ^uint32(0))
+	s.inflight.Done()
+}
+
+// Close stops the server. Queries that are being processed are given up to
+// timeout to complete before sockets are closed, new queries are dropped.
+func (s *Server) Close(timeout time.Duration) {
+	s.closingLock.Lock()
+	s.closing = true
+	s.closingLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("Shutdown timeout elapsed,", atomic.LoadUint32(&s.inflightCnt), "queries are still pending")
+	}
+
+	close(s.stop)
+	for _, dnsSrv := range s.servers {
+		dnsSrv.Shutdown()
+	}
+	for _, httpSrv := range s.httpServers {
+		httpSrv.Close()
+	}
+	if s.dnscrypt != nil {
+		s.dnscrypt.close()
+	}
+	if s.controlL != nil {
+		s.controlL.Close()
+	}
+	if s.queryLog != nil {
+		s.queryLog.Close()
+	}
+	if s.cacheFile != "" {
+		n, err := s.cache.save(s.cacheFile)
+		if err != nil {
+			log.Println("Failed to save cache:", err)
+		} else {
+			log.Println("Saved", n, "cached responses to", s.cacheFile)
+		}
+	}
+}
+
+// statsSnapshot holds query counters at some point in time.
+type statsSnapshot struct {
+	at      time.Time
+	blocked uint32
+	total   uint32
+}
+
+// percent returns part as a rounded percentage of total, 0 if total is 0.
+func percent(part, total uint32) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(part) / float64(total) * 100.0)
+}
+
+// logStats logs counters, e.g. on SIGUSR1. Queries are counted both in total
+// and since the previous call (or startup), so it can be used to see the rate
+// between signals.
+func (s *Server) logStats() {
+	now := statsSnapshot{
+		at:      time.Now(),
+		blocked: atomic.LoadUint32(&s.blockedCnt),
+		total:   atomic.LoadUint32(&s.totalCnt),
+	}
+	last := s.lastStats
+	if last.at.IsZero() {
+		last.at = s.startTime
+	}
+	s.lastStats = now
+
+	blocked, total := now.blocked, now.total
+	newBlocked, newTotal := blocked-last.blocked, total-last.total
+	since := now.at.Sub(last.at).Round(time.Second)
+	switch {
+	case total == 0:
+		log.Println("No queries yet")
+	case s.monitorMode:
+		log.Printf("Monitor mode: %d out of %d queries would be blocked (%v%%), %d out of %d in the last %v (%v%%)",
+			blocked, total, percent(blocked, total), newBlocked, newTotal, since, percent(newBlocked, newTotal))
 	default:
-		fmt.Fprintf(os.Stderr, "Usage: %s [config path]\n", os.Args[0])
-		os.Exit(2)
+		log.Printf("Blocked %d out of %d queries (%v%%), %d out of %d in the last %v (%v%%)",
+			blocked, total, percent(blocked, total), newBlocked, newTotal, since, percent(newBlocked, newTotal))
+	}
+	if len(s.blockQtypes) != 0 {
+		log.Printf("Blocked %d queries by record type", atomic.LoadUint32(&s.qtypeBlockedCnt))
+	}
+	if s.rateLimit != nil {
+		log.Printf("Dropped %d queries due to rate limit", atomic.LoadUint32(&s.rateLimitedCnt))
+	}
+	if s.retries != 0 {
+		log.Printf("Retried %d downstream exchanges", atomic.LoadUint32(&s.retryCnt))
+	}
+	if s.exchangeSlots != nil {
+		log.Printf("Failed %d downstream exchanges due to max_inflight_downstream", atomic.LoadUint32(&s.inflightLimitedCnt))
+	}
+	if s.externalPolicy != nil {
+		log.Printf("Used lists for %d queries due to external policy failures", atomic.LoadUint32(&s.externalPolicyErrCnt))
 	}
 
-	log.SetFlags(0)
+	if s.blockHits != nil {
+		for i, hit := range s.blockHits.top(10) {
+			log.Printf("Top blocked #%d: %s (%d)", i+1, hit.Name, hit.Count)
+		}
+	}
 
-	var cfg Config
-	_, err := toml.DecodeFile(cfgPath, &cfg)
-	if err != nil {
-		log.Println(err)
-		os.Exit(2)
+	for _, d := range s.allDownstreams() {
+		st := newDownstreamStats(d)
+		state := "up"
+		if !st.Up {
+			state = "down"
+		}
+		if s.breaker != nil {
+			state += ", circuit " + d.breaker.current()
+		}
+		log.Printf("Downstream %s: %s, %d queries, %.1f%% errors, RTT p50/p95/p99 %.1f/%.1f/%.1f ms",
+			d.name, state, st.Queries, st.ErrorPercent, st.RTTp50Ms, st.RTTp95Ms, st.RTTp99Ms)
 	}
+}
 
-	black, err := readLists(cfg.Blacklists)
-	if err != nil {
-		log.Println("Blacklist read failed:", err)
-		os.Exit(2)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		log.SetFlags(0)
+		os.Exit(runCheck(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compile-lists" {
+		log.SetFlags(0)
+		os.Exit(runCompileLists(os.Args[2:]))
 	}
-	white, err := readLists(cfg.Whitelists)
+	if len(os.Args) > 1 && (os.Args[1] == "--check-config" || os.Args[1] == "-check-config") {
+		log.SetFlags(0)
+		os.Exit(runCheckConfig(os.Args[2:]))
+	}
+
+	cfgPaths := []string{"/etc/rhole.toml"}
+	if len(os.Args) > 1 {
+		if strings.HasPrefix(os.Args[1], "-") {
+			fmt.Fprintf(os.Stderr, "Usage: %s [config path...]\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "       %s --check-config [config path...]\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "       %s check [-config path] domain...\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "       %s compile-lists [-config path] [output]\n", os.Args[0])
+			os.Exit(2)
+		}
+		cfgPaths = os.Args[1:]
+	}
+
+	log.SetFlags(0)
+
+	cfg, err := loadConfig(cfgPaths...)
 	if err != nil {
-		log.Println("Whitelist read failed:", err)
+		log.Println(err)
 		os.Exit(2)
 	}
-	for ent := range white {
-		delete(black, ent)
+	if err := setupLogging(cfg.LogTarget); err != nil {
+		log.Println(err)
+		os.Exit(2)
 	}
-	white = nil // free extra memory if whitelist is big
-	log.Println("Blocking", len(black), "domains")
+	setStrictIDNA(cfg.StrictIDNA)
 
-	if cfg.DownstreamTimeoutSecs == 0 {
-		cfg.DownstreamTimeoutSecs = 5
+	var lists *domainLists
+	if cfg.StartupMode == startupWait {
+		// The server does not exist yet, categories have configured states.
+		lists, err = loadLists(cfg, categoryStates(cfg.Categories))
+		if err != nil {
+			log.Println(err)
+			os.Exit(2)
+		}
+		if err := checkBlacklist(cfg, lists); err != nil {
+			log.Println(err)
+			os.Exit(2)
+		}
 	}
 
-	s, err := NewServer(cfg.Listen, black, cfg.Downstreams, time.Duration(cfg.DownstreamTimeoutSecs)*time.Second)
+	s, err := NewServer(cfg, lists)
 	if err != nil {
 		log.Println("Server init failed:", err)
 		os.Exit(2)
 	}
+	if cfg.User != "" {
+		uid, gid, err := lookupIDs(cfg.User, cfg.Group)
+		if err == nil && cfg.ControlSocket != "" {
+			err = os.Chown(cfg.ControlSocket, uid, gid)
+		}
+		if err == nil {
+			err = dropPrivileges(uid, gid)
+		}
+		if err != nil {
+			log.Println("Failed to drop privileges:", err)
+			os.Exit(2)
+		}
+		log.Println("Running as user", cfg.User)
+	}
 
+	s.logSummary()
 	go s.Serve()
-	log.Println("Listening on", cfg.Listen)
-	defer s.Close()
+	if lists == nil {
+		go s.loadInitialLists()
+	}
+	defer s.Close(time.Duration(cfg.ShutdownTimeoutSecs) * time.Second)
+
+	if cfg.ReloadIntervalSecs != 0 {
+		go s.reloadLoop(time.Duration(cfg.ReloadIntervalSecs)*time.Second, time.Duration(cfg.ReloadJitterSecs)*time.Second)
+	}
+	if cfg.HealthCheckIntervalSecs != 0 {
+		go s.healthCheckLoop(time.Duration(cfg.HealthCheckIntervalSecs)*time.Second,
+			time.Duration(cfg.HealthCheckMaxBackoffSecs)*time.Second, cfg.HealthCheckName)
+	}
 
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt, unix.SIGTERM, unix.SIGUSR1)
+	signal.Notify(ch, os.Interrupt, unix.SIGTERM, unix.SIGUSR1, unix.SIGHUP)
 
 	for {
-		sig := <-ch
-		if sig.String() == unix.SIGUSR1.String() {
-			blocked := atomic.LoadUint32(&s.blockedCnt)
-			total := atomic.LoadUint32(&s.totalCnt)
-			log.Printf("Blocked %d out of %d queries (%v%%)", blocked, total, math.Round(float64(blocked)/float64(total)*100.0))
-			continue
+		switch <-ch {
+		case unix.SIGUSR1:
+			s.logStats()
+		case unix.SIGHUP:
+			newCfg, err := loadConfig(cfgPaths...)
+			if err != nil {
+				log.Println("Config reload failed:", err)
+				continue
+			}
+			if err := s.reloadConfig(newCfg); err != nil {
+				log.Println("Config reload failed:", err)
+			}
+		default:
+			return
 		}
-		return
 	}
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestServer creates a server using config with lists loaded, listen is
+// set since it is required but the server does not listen. files are written
+// to a temporary directory first, "$DIR" in config is replaced with its path.
+func newTestServer(t *testing.T, config string, files map[string]string) *Server {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "rhole-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	config = "listen = \"127.0.0.1:0\"\n" + strings.ReplaceAll(config, "$DIR", dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "rhole.toml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := loadConfig(filepath.Join(dir, "rhole.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lists, err := loadLists(cfg, categoryStates(cfg.Categories))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(cfg, lists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testWriter records the message written by ServeDNS.
+type testWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *testWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) TsigStatus() error           { return nil }
+func (w *testWriter) TsigTimersOnly(bool)         {}
+func (w *testWriter) Hijack()                     {}
+
+// serve passes m to s.ServeDNS as if it was received from 127.0.0.1 over
+// network (udp or tcp) and returns the reply, nil if none was written.
+func serve(s *Server, network string, m *dns.Msg) *dns.Msg {
+	w := &testWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10053}}
+	if network == "tcp" {
+		w.remote = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10053}
+	}
+	s.ServeDNS(w, m)
+	return w.msg
+}
+
+func TestServeDNSTruncatedDownstream(t *testing.T) {
+	addr := startStub(t, truncatingStub(3))
+
+	cases := []struct {
+		name   string
+		config string
+	}{
+		{"cache", `downstreams = ["` + addr + `"]
+cache_size = 10`},
+		{"parallel", `downstreams = ["` + addr + `", "` + addr + `"]
+parallel_downstreams = 2`},
+	}
+	for _, c := range cases {
+		s := newTestServer(t, c.config, nil)
+		// The second query is answered from the cache, if enabled.
+		for i := 0; i < 2; i++ {
+			m := new(dns.Msg)
+			m.SetQuestion("big.example.org.", dns.TypeA)
+			m.SetEdns0(4096, false)
+			reply := serve(s, "udp", m)
+			if reply == nil {
+				t.Fatalf("%s: no reply", c.name)
+			}
+			if reply.Truncated || len(reply.Answer) != 3 {
+				t.Errorf("%s: query %d: TC is %v with %d answers, expected full response", c.name, i, reply.Truncated, len(reply.Answer))
+			}
+		}
+	}
+}
+
+func TestServeDNSOpcodes(t *testing.T) {
+	addr := startStub(t, answeringStub)
+	s := newTestServer(t, `downstreams = ["`+addr+`"]`, nil)
+
+	cases := []struct {
+		opcode int
+		rcode  int
+	}{
+		{dns.OpcodeQuery, dns.RcodeSuccess},
+		{dns.OpcodeUpdate, dns.RcodeRefused},
+		{dns.OpcodeNotify, dns.RcodeNotImplemented},
+		{dns.OpcodeStatus, dns.RcodeNotImplemented},
+		{dns.OpcodeIQuery, dns.RcodeNotImplemented},
+	}
+	for _, c := range cases {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		m.Opcode = c.opcode
+		reply := serve(s, "udp", m)
+		if reply == nil {
+			t.Fatalf("%s: no reply", dns.OpcodeToString[c.opcode])
+		}
+		if reply.Rcode != c.rcode {
+			t.Errorf("%s: rcode %s, expected %s", dns.OpcodeToString[c.opcode],
+				dns.RcodeToString[reply.Rcode], dns.RcodeToString[c.rcode])
+		}
+		if reply.Opcode != c.opcode {
+			t.Errorf("%s: reply has opcode %s", dns.OpcodeToString[c.opcode], dns.OpcodeToString[reply.Opcode])
+		}
+	}
+}
+
+func TestServeDNSQuestionCount(t *testing.T) {
+	addr := startStub(t, answeringStub)
+	s := newTestServer(t, `downstreams = ["`+addr+`"]`, nil)
+
+	q := dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	cases := []struct {
+		questions []dns.Question
+		rcode     int
+	}{
+		{nil, dns.RcodeFormatError},
+		{[]dns.Question{q}, dns.RcodeSuccess},
+		{[]dns.Question{q, q}, dns.RcodeFormatError},
+	}
+	for _, c := range cases {
+		m := new(dns.Msg)
+		m.Id = dns.Id()
+		m.RecursionDesired = true
+		m.Question = c.questions
+		reply := serve(s, "udp", m)
+		if reply == nil {
+			t.Fatalf("%d questions: no reply", len(c.questions))
+		}
+		if reply.Rcode != c.rcode {
+			t.Errorf("%d questions: rcode %s, expected %s", len(c.questions),
+				dns.RcodeToString[reply.Rcode], dns.RcodeToString[c.rcode])
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// parseRPZ reads a Response Policy Zone file and adds its QNAME triggers to
+// the sets: NXDOMAIN (CNAME .) and NODATA (CNAME *.) rules are added to
+// black, NODATA ones also to nodata so that they get NODATA replies
+// regardless of block_mode. PASSTHRU (CNAME rpz-passthru.) rules are added to
+// white. Wildcard triggers (*.example.org) match subdomains only. Other
+// triggers and actions are skipped.
+func parseRPZ(r io.Reader, file string, black, white, nodata *domainSet) error {
+	r, err := gunzip(r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	size, dups := black.size(), black.duplicates
+	zp := dns.NewZoneParser(r, ".", file)
+	apex := ""
+	skipped := 0
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		hdr := rr.Header()
+		if apex == "" {
+			if hdr.Rrtype != dns.TypeSOA {
+				return fmt.Errorf("%s: zone does not start with SOA", file)
+			}
+			apex = strings.ToLower(hdr.Name)
+			continue
+		}
+
+		owner := strings.ToLower(hdr.Name)
+		if owner == apex || !dns.IsSubDomain(apex, owner) {
+			continue
+		}
+		trigger := strings.TrimSuffix(strings.TrimSuffix(owner, apex), ".")
+		if isRPZSpecialTrigger(trigger) {
+			skipped++
+			continue
+		}
+
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			// Local data.
+			skipped++
+			continue
+		}
+		var set *domainSet
+		target := strings.ToLower(cname.Target)
+		switch target {
+		case ".", "*.":
+			set = black
+		case "rpz-passthru.":
+			set = white
+		default:
+			skipped++
+			continue
+		}
+		if strings.HasPrefix(trigger, "*.") {
+			domain := set.normalizeEntry(strings.TrimPrefix(trigger, "*."))
+			set.addWildcard(domain)
+			if target == "*." {
+				nodata.addWildcard(domain)
+			}
+		} else {
+			domain := set.normalizeEntry(trigger)
+			set.add(domain)
+			if target == "*." {
+				nodata.add(domain)
+			}
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+
+	if skipped != 0 {
+		log.Printf("Skipped %d unsupported rules in %s", skipped, file)
+	}
+	black.track(file, size, dups)
+	white.reportInvalid(file)
+	return nil
+}
+
+// isRPZSpecialTrigger reports whether the trigger is not a QNAME trigger
+// (IP, NSDNAME, NSIP or client IP).
+func isRPZSpecialTrigger(trigger string) bool {
+	for _, label := range dns.SplitDomainName(trigger) {
+		switch label {
+		case "rpz-ip", "rpz-nsdname", "rpz-nsip", "rpz-client-ip":
+			return true
+		}
+	}
+	return false
+}
+
+// readRPZ reads policy zones from files and URLs into the sets, see parseRPZ.
+// Zones that cannot be downloaded are skipped, like lists.
+func readRPZ(paths []string, cfg Config, black, white, nodata *domainSet) error {
+	cl := &http.Client{
+		Timeout: time.Duration(cfg.ListFetchTimeoutSecs) * time.Second,
+	}
+
+	for _, path := range paths {
+		if isURL(path) {
+			body, err := fetchList(cl, path, listCachePath(cfg.ListCacheDir, path))
+			if err != nil {
+				continue
+			}
+			if err := parseRPZ(bytes.NewReader(body), path, black, white, nodata); err != nil {
+				return err
+			}
+			continue
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = parseRPZ(file, path, black, white, nodata)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketControl returns the net.ListenConfig.Control function that sets
+// SO_REUSEPORT and binds the socket to iface if it is not empty.
+func socketControl(iface string, reusePort bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if reusePort {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+				if sockErr != nil {
+					return
+				}
+			}
+			if iface != "" {
+				sockErr = bindToDevice(int(fd), iface)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// setUDPBuffers sets receive and send buffer sizes of the UDP socket conn,
+// sizes of 0 are left as is. The resulting sizes are logged since the
+// kernel may clamp (or, on Linux, double) them.
+func setUDPBuffers(conn net.PacketConn, name string, readSize, writeSize int) error {
+	if readSize == 0 && writeSize == 0 {
+		return nil
+	}
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var (
+		sockErr     error
+		read, write int
+	)
+	err = rc.Control(func(fd uintptr) {
+		if readSize != 0 {
+			if sockErr = setSocketBuffer(int(fd), unix.SO_RCVBUF, readSize); sockErr != nil {
+				return
+			}
+		}
+		if writeSize != 0 {
+			if sockErr = setSocketBuffer(int(fd), unix.SO_SNDBUF, writeSize); sockErr != nil {
+				return
+			}
+		}
+		read, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+		write, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return sockErr
+	}
+	log.Printf("UDP socket buffers on %s: read %d, write %d bytes", name, read, write)
+	return nil
+}
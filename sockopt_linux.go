@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func bindToDevice(fd int, iface string) error {
+	return unix.BindToDevice(fd, iface)
+}
+
+// setSocketBuffer sets SO_RCVBUF or SO_SNDBUF. The *BUFFORCE variants are
+// tried first to go over net.core.rmem_max and wmem_max, they require
+// CAP_NET_ADMIN.
+func setSocketBuffer(fd, opt, size int) error {
+	force := unix.SO_RCVBUFFORCE
+	if opt == unix.SO_SNDBUF {
+		force = unix.SO_SNDBUFFORCE
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, force, size); err == nil {
+		return nil
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, size)
+}
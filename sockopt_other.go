@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+func bindToDevice(fd int, iface string) error {
+	return errors.New("binding to an interface is supported only on Linux")
+}
+
+// setSocketBuffer sets SO_RCVBUF or SO_SNDBUF.
+func setSocketBuffer(fd, opt, size int) error {
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, size)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Values of startup_mode: wait loads lists before listening, others start
+// serving right away and answer queries as named until lists are loaded.
+const (
+	startupWait     = "wait"
+	startupFail     = "fail"
+	startupForward  = "forward"
+	startupBlockAll = "block_all"
+)
+
+func checkStartupMode(mode string) error {
+	switch mode {
+	case startupWait, startupFail, startupForward, startupBlockAll:
+		return nil
+	default:
+		return fmt.Errorf("unknown startup_mode: %s", mode)
+	}
+}
+
+// loadInitialLists loads lists for a server created without them. rhole
+// exits if that fails, as it does if lists cannot be loaded before listening.
+func (s *Server) loadInitialLists() {
+	start := time.Now()
+	if err := s.reloadLists(); err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+	log.Printf("Lists loaded in %v, startup_mode no longer applies", time.Since(start).Round(time.Millisecond))
+}
+
+// startupReply answers m according to startup_mode if lists are not loaded
+// yet and reports whether it did, false if the query should be processed as
+// usual. Queries blocked meanwhile are counted as any other blocked query.
+func (s *Server) startupReply(v *view, w dns.ResponseWriter, m *dns.Msg, ql *queryLogEntry, name string) bool {
+	s.listsLock.RLock()
+	loaded := s.lists != nil
+	s.listsLock.RUnlock()
+	if loaded {
+		return false
+	}
+
+	switch s.startupMode {
+	case startupFail:
+		reply := new(dns.Msg)
+		reply.SetRcode(m, dns.RcodeRefused)
+		reply.RecursionAvailable = s.recursion
+		if err := w.WriteMsg(reply); err != nil {
+			log.Printf("WriteMsg: %v", err)
+		}
+		return true
+	case startupBlockAll:
+		return s.block(v, w, m, ql, name)
+	}
+	// Forwarded as is, isBlocked reports nothing as blocked.
+	return false
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStartupReply(t *testing.T) {
+	addr := startStub(t, answeringStub)
+
+	cases := []struct {
+		mode    string
+		rcode   int
+		blocked uint32
+	}{
+		{startupFail, dns.RcodeRefused, 0},
+		{startupForward, dns.RcodeSuccess, 0},
+		{startupBlockAll, dns.RcodeNameError, 1},
+	}
+	for _, c := range cases {
+		s := newTestServer(t, `downstreams = ["`+addr+`"]
+block_stats_size = 10
+startup_mode = "`+c.mode+`"`, nil)
+		// Lists are not loaded yet.
+		s.lists = nil
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		reply := serve(s, "udp", m)
+		if reply == nil {
+			t.Fatalf("%s: no reply", c.mode)
+		}
+		if reply.Rcode != c.rcode {
+			t.Errorf("%s: rcode %s, expected %s", c.mode, dns.RcodeToString[reply.Rcode], dns.RcodeToString[c.rcode])
+		}
+		if n := atomic.LoadUint32(&s.blockedCnt); n != c.blocked {
+			t.Errorf("%s: %d queries counted as blocked, expected %d", c.mode, n, c.blocked)
+		}
+		if hits := s.blockHits.top(10); uint32(len(hits)) != c.blocked {
+			t.Errorf("%s: top blocked names are %v", c.mode, hits)
+		}
+	}
+}
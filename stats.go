@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type downstreamStats struct {
+	Name         string  `json:"name"`
+	Up           bool    `json:"up"`
+	Queries      uint32  `json:"queries"`
+	Errors       uint32  `json:"errors"`
+	ErrorPercent float64 `json:"error_percent"`
+	// Round-trip time percentiles of recent successful exchanges.
+	RTTp50Ms float64 `json:"rtt_p50_ms"`
+	RTTp95Ms float64 `json:"rtt_p95_ms"`
+	RTTp99Ms float64 `json:"rtt_p99_ms"`
+	// Consecutive failed health checks and the current delay between them.
+	HealthFailures    int     `json:"health_failures"`
+	HealthBackoffSecs float64 `json:"health_backoff_secs"`
+	// Failed exchanges by kind, the rest of errors are other failures (bad
+	// responses, TLS errors, etc).
+	RefusedErrors     uint32 `json:"refused_errors"`
+	UnreachableErrors uint32 `json:"unreachable_errors"`
+	TimeoutErrors     uint32 `json:"timeout_errors"`
+	// Circuit breaker state (closed, open or half-open), empty if disabled.
+	Circuit string `json:"circuit,omitempty"`
+}
+
+func newDownstreamStats(d *downstream) downstreamStats {
+	st := downstreamStats{
+		Name:    d.name,
+		Up:      d.isUp(),
+		Queries: atomic.LoadUint32(&d.queries),
+		Errors:  atomic.LoadUint32(&d.errors),
+	}
+	if st.Queries != 0 {
+		st.ErrorPercent = float64(st.Errors) / float64(st.Queries) * 100
+	}
+	rtt := d.rtt.percentiles(rttQuantiles...)
+	st.RTTp50Ms = float64(rtt[0]) / float64(time.Millisecond)
+	st.RTTp95Ms = float64(rtt[1]) / float64(time.Millisecond)
+	st.RTTp99Ms = float64(rtt[2]) / float64(time.Millisecond)
+	failures, backoff := d.probe.state()
+	st.HealthFailures = failures
+	st.HealthBackoffSecs = backoff.Seconds()
+	st.RefusedErrors = atomic.LoadUint32(&d.refused)
+	st.UnreachableErrors = atomic.LoadUint32(&d.unreachable)
+	st.TimeoutErrors = atomic.LoadUint32(&d.timeouts)
+	return st
+}
+
+type stats struct {
+	Total           uint32            `json:"total"`
+	Blocked         uint32            `json:"blocked"`
+	BlockedPercent  float64           `json:"blocked_percent"`
+	BlacklistSize   int               `json:"blacklist_size"`
+	UptimeSecs      int64             `json:"uptime_secs"`
+	MonitorMode     bool              `json:"monitor_mode"`
+	Retries         uint32            `json:"retries"`
+	InflightLimited uint32            `json:"inflight_limited"`
+	Downstreams     []downstreamStats `json:"downstreams"`
+	TopBlocked      []hitCount        `json:"top_blocked,omitempty"`
+	// Domains each blacklist added on load and its overlap with others.
+	Lists []listContribution `json:"lists"`
+}
+
+// stats returns current statistics including up to top most blocked names.
+func (s *Server) stats(top int) stats {
+	st := stats{
+		Total:           atomic.LoadUint32(&s.totalCnt),
+		Blocked:         atomic.LoadUint32(&s.blockedCnt),
+		UptimeSecs:      int64(time.Since(s.startTime) / time.Second),
+		Retries:         atomic.LoadUint32(&s.retryCnt),
+		InflightLimited: atomic.LoadUint32(&s.inflightLimitedCnt),
+		MonitorMode:     s.monitorMode,
+		Downstreams:     make([]downstreamStats, 0, len(s.downstreams)),
+	}
+	if st.Total != 0 {
+		st.BlockedPercent = float64(st.Blocked) / float64(st.Total) * 100
+	}
+	s.listsLock.RLock()
+	if s.lists != nil {
+		st.BlacklistSize = s.lists.size()
+		st.Lists = s.lists.contributions
+	}
+	s.listsLock.RUnlock()
+
+	for _, d := range s.allDownstreams() {
+		dst := newDownstreamStats(d)
+		if s.breaker != nil {
+			dst.Circuit = d.breaker.current()
+		}
+		st.Downstreams = append(st.Downstreams, dst)
+	}
+
+	if s.blockHits != nil {
+		st.TopBlocked = s.blockHits.top(top)
+	}
+	return st
+}
+
+func (s *Server) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	top := 10
+	if n, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && n > 0 {
+		top = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stats(top))
+}
+
+// localhostAddr binds addr to the loopback interface if it does not specify
+// the host.
+func localhostAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// logSummary logs the effective configuration as a single message, so it is
+// easy to confirm that the configuration files were picked up as intended.
+func (s *Server) logSummary() {
+	cfg := s.config()
+
+	s.listsLock.RLock()
+	lists := s.lists
+	s.listsLock.RUnlock()
+
+	var b strings.Builder
+	line := func(key, format string, args ...interface{}) {
+		fmt.Fprintf(&b, "\n  %-18s %s", key+":", fmt.Sprintf(format, args...))
+	}
+
+	b.WriteString("Effective configuration:")
+	line("config files", "%s", strings.Join(cfg.files, ", "))
+	line("listen", "%s", strings.Join(cfg.Listen, ", "))
+	if len(cfg.TLSListen) != 0 {
+		line("tls listen", "%s", strings.Join(cfg.TLSListen, ", "))
+	}
+	if cfg.DoHListen != "" {
+		line("doh listen", "%s", cfg.DoHListen)
+	}
+	if len(cfg.DNSCryptListen) != 0 {
+		line("dnscrypt listen", "%s (%s)", strings.Join(cfg.DNSCryptListen, ", "), cfg.DNSCryptProviderName)
+	}
+
+	if s.recursion {
+		downstreams := make([]string, 0, len(s.downstreams))
+		for _, d := range s.downstreams {
+			downstreams = append(downstreams, d.transport()+" "+d.name)
+		}
+		line("downstreams", "%d (%s)", len(s.downstreams), strings.Join(downstreams, ", "))
+		line("timeouts", "dial %v, read %v, write %v",
+			time.Duration(cfg.DialTimeoutSecs)*time.Second,
+			time.Duration(cfg.ReadTimeoutSecs)*time.Second,
+			time.Duration(cfg.WriteTimeoutSecs)*time.Second)
+		line("retries", "%d", cfg.DownstreamRetries)
+	} else {
+		line("recursion", "disabled")
+	}
+
+	line("lists", "%d blacklists, %d whitelists, %d RPZ zones, %d categories",
+		len(cfg.Blacklists), len(cfg.Whitelists), len(cfg.RPZZones), len(cfg.Categories))
+	if lists != nil {
+		line("blocking", "%d domains (%d whitelisted), %d conditional forwarders",
+			lists.size(), lists.white.size(), len(lists.forwarders))
+	} else {
+		line("blocking", "lists are loading (startup_mode %s)", cfg.StartupMode)
+	}
+	if len(s.views) != 0 {
+		names := make([]string, 0, len(s.views))
+		for _, v := range s.views {
+			names = append(names, v.name)
+		}
+		line("views", "%s", strings.Join(names, ", "))
+	}
+	mode := cfg.BlockMode
+	if s.policy.cname != "" {
+		mode += ", CNAME to " + s.policy.cname
+	}
+	if s.allowlistMode {
+		mode += " for names not whitelisted"
+	}
+	if s.monitorMode {
+		mode += " (monitor mode)"
+	}
+	line("block mode", "%s, TTL %d", mode, cfg.BlockTTL)
+
+	if s.cache != nil {
+		line("cache", "%d entries", cfg.CacheSize)
+	} else {
+		line("cache", "disabled")
+	}
+	line("metrics", "%s", enabledAt(cfg.MetricsListen))
+	line("stats", "%s", enabledAt(cfg.StatsListen))
+	line("control socket", "%s", enabledAt(cfg.ControlSocket))
+	if len(s.allowedClients) != 0 {
+		line("acl", "%d networks allowed", len(s.allowedClients))
+	} else {
+		line("acl", "disabled")
+	}
+	if s.rateLimit != nil {
+		line("rate limit", "%d qps, burst %d", cfg.ClientQPS, cfg.ClientBurst)
+	} else {
+		line("rate limit", "disabled")
+	}
+
+	var features []string
+	for _, f := range []struct {
+		name string
+		on   bool
+	}{
+		{"qname_minimization", s.qnameMinimization},
+		{"case_randomization", s.caseRandomization},
+		{"validate_dnssec", s.validator != nil},
+		{"cname_uncloaking", s.cnameUncloaking},
+		{"block_subdomains", s.blockSubdomains},
+		{"block_private_ptr", s.blockPrivatePTR},
+		{"strip_dnssec_for_clients", s.stripDNSSEC},
+		{"valid_tlds", s.validTLDs != nil},
+		{"rebind_protection", s.rebindMode != rebindOff},
+		{"local_records", s.local != nil},
+		{"external_policy", s.externalPolicy != nil},
+		{"circuit_breaker", s.breaker != nil},
+		{"strict_idna", s.strictIDNA},
+	} {
+		if f.on {
+			features = append(features, f.name)
+		}
+	}
+	if len(features) == 0 {
+		features = []string{"none"}
+	}
+	line("features", "%s", strings.Join(features, ", "))
+
+	log.Print(b.String())
+}
+
+// enabledAt formats an optional address or path for logSummary.
+func enabledAt(addr string) string {
+	if addr == "" {
+		return "disabled"
+	}
+	return addr
+}
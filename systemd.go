@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+// listenSystemd is the listen value that stands for sockets passed using
+// systemd socket activation.
+const listenSystemd = "systemd"
+
+// First file descriptor passed by systemd, see sd_listen_fds(3).
+const listenFdsStart = 3
+
+// systemdFiles returns sockets passed to the process by systemd or nil if
+// there are none. The environment variables are unset, so the sockets are
+// not passed to children.
+func systemdFiles() []*os.File {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	files := make([]*os.File, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		unix.CloseOnExec(fd)
+		files = append(files, os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd)))
+	}
+	return files
+}
+
+// listenSystemd creates DNS servers for sockets passed by systemd: TCP
+// servers for stream sockets and UDP ones for datagram sockets.
+func (s *Server) listenSystemd() error {
+	files := systemdFiles()
+	if len(files) == 0 {
+		return errors.New("listen: no sockets passed by systemd (LISTEN_FDS is not set)")
+	}
+	for _, f := range files {
+		err := s.adoptSocket(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("listen: %s: %w", f.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) adoptSocket(f *os.File) error {
+	// f.Fd() would put the socket into blocking mode.
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var (
+		sockType int
+		sockErr  error
+	)
+	err = rc.Control(func(fd uintptr) {
+		sockType, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TYPE)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return sockErr
+	}
+
+	switch sockType {
+	case unix.SOCK_STREAM:
+		l, err := net.FileListener(f)
+		if err != nil {
+			return err
+		}
+		s.servers = append(s.servers, &dns.Server{Listener: l, Handler: s, MsgAcceptFunc: acceptMsg})
+	case unix.SOCK_DGRAM:
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			return err
+		}
+		if err := setUDPBuffers(pc, pc.LocalAddr().String(), s.udpReadBuffer, s.udpWriteBuffer); err != nil {
+			pc.Close()
+			return err
+		}
+		s.servers = append(s.servers, &dns.Server{PacketConn: pc, Handler: s, MsgAcceptFunc: acceptMsg})
+	default:
+		return fmt.Errorf("unsupported socket type %d", sockType)
+	}
+	return nil
+}
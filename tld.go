@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// loadTLDs reads the list of valid TLDs from a file or URL in the format of
+// https://data.iana.org/TLD/tlds-alpha-by-domain.txt: one TLD per line, lines
+// starting with # are comments. internal TLDs are added to the result.
+func loadTLDs(path string, internal []string, cfg Config) (map[string]struct{}, error) {
+	var (
+		body []byte
+		err  error
+	)
+	if isURL(path) {
+		cl := &http.Client{
+			Timeout: time.Duration(cfg.ListFetchTimeoutSecs) * time.Second,
+		}
+		body, err = fetchList(cl, path, listCachePath(cfg.ListCacheDir, path))
+	} else {
+		body, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tlds := make(map[string]struct{}, 1600)
+	scnr := bufio.NewScanner(bytes.NewReader(body))
+	for scnr.Scan() {
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tlds[normalize(line)] = struct{}{}
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	for _, tld := range internal {
+		tlds[normalize(tld)] = struct{}{}
+	}
+	return tlds, nil
+}
+
+// invalidTLDReply answers queries for names in TLDs missing from valid_tlds
+// with NXDOMAIN. nil is returned for other queries and if valid_tlds is not
+// set. Names with conditional forwarders are never rejected.
+func (s *Server) invalidTLDReply(v *view, m *dns.Msg, name string) *dns.Msg {
+	if s.validTLDs == nil || name == "" {
+		return nil
+	}
+	tld := name[strings.LastIndexByte(name, '.')+1:]
+	if _, ok := s.validTLDs[tld]; ok {
+		return nil
+	}
+	if s.forwarder(v, name) != nil {
+		return nil
+	}
+
+	atomic.AddUint32(&s.invalidTLDCnt, 1)
+	return s.nxdomainReply(m)
+}
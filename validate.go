@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// configErrors lists all problems found by validateConfig.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(e, "\n\t")
+}
+
+// validateConfig checks options that can be checked without side effects, so
+// mistakes are reported at once and before any sockets are created.
+func validateConfig(cfg Config) error {
+	var errs configErrors
+	addErr := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if len(cfg.Listen) == 0 && len(cfg.TLSListen) == 0 && cfg.DoHListen == "" && len(cfg.DNSCryptListen) == 0 {
+		addErr("listen: no addresses")
+	}
+	if len(cfg.DNSCryptListen) != 0 {
+		name := strings.ToLower(cfg.DNSCryptProviderName)
+		if _, ok := dns.IsDomainName(name); !ok || !strings.HasPrefix(name, "2.dnscrypt-cert.") {
+			addErr("dnscrypt_provider_name: must be a domain name starting with 2.dnscrypt-cert.")
+		}
+		if cfg.DNSCryptKeyFile == "" {
+			addErr("dnscrypt_key_file: required for dnscrypt_listen")
+		}
+	}
+	for i, addr := range cfg.Listen {
+		if addr == listenSystemd {
+			continue
+		}
+		if err := checkListenAddr(addr); err != nil {
+			addErr("listen[%d]: %v", i, err)
+		}
+	}
+	for i, addr := range cfg.TLSListen {
+		if err := checkListenAddr(addr); err != nil {
+			addErr("tls_listen[%d]: %v", i, err)
+		}
+	}
+
+	if len(cfg.Downstreams) == 0 && cfg.Recursion {
+		addErr("downstreams: no downstreams")
+	}
+	for i, entry := range cfg.Downstreams {
+		if err := checkDownstream(entry); err != nil {
+			addErr("downstreams[%d]: %v", i, err)
+		}
+	}
+
+	for _, opt := range []struct {
+		name  string
+		value int
+	}{
+		{"downstream_timeout_secs", cfg.DownstreamTimeoutSecs},
+		{"dial_timeout_secs", cfg.DialTimeoutSecs},
+		{"read_timeout_secs", cfg.ReadTimeoutSecs},
+		{"write_timeout_secs", cfg.WriteTimeoutSecs},
+		{"downstream_retries", cfg.DownstreamRetries},
+		{"list_fetch_timeout_secs", cfg.ListFetchTimeoutSecs},
+		{"reload_interval_secs", cfg.ReloadIntervalSecs},
+		{"reload_jitter_secs", cfg.ReloadJitterSecs},
+		{"health_check_interval_secs", cfg.HealthCheckIntervalSecs},
+		{"health_check_max_backoff_secs", cfg.HealthCheckMaxBackoffSecs},
+		{"circuit_breaker_window", cfg.CircuitBreakerWindow},
+		{"circuit_breaker_cooldown_secs", cfg.CircuitBreakerCooldownSecs},
+		{"shutdown_timeout_secs", cfg.ShutdownTimeoutSecs},
+		{"max_stale_secs", cfg.MaxStaleSecs},
+		{"udp_read_buffer", cfg.UDPReadBuffer},
+		{"udp_write_buffer", cfg.UDPWriteBuffer},
+	} {
+		if opt.value < 0 {
+			addErr("%s: must not be negative", opt.name)
+		}
+	}
+
+	if cfg.User != "" {
+		if _, _, err := lookupIDs(cfg.User, cfg.Group); err != nil {
+			addErr("%v", err)
+		}
+	} else if cfg.Group != "" {
+		addErr("group: user must be set too")
+	}
+
+	checkLists := func(option string, paths []string) {
+		for i, path := range paths {
+			if err := checkListPath(path); err != nil {
+				addErr("%s[%d]: %v", option, i, err)
+			}
+		}
+	}
+	checkLists("blacklists", cfg.Blacklists)
+	checkLists("whitelists", cfg.Whitelists)
+	checkLists("rpz_zones", cfg.RPZZones)
+	if cfg.ValidTLDs != "" {
+		if err := checkListPath(cfg.ValidTLDs); err != nil {
+			addErr("valid_tlds: %v", err)
+		}
+	} else if len(cfg.InternalTLDs) != 0 {
+		addErr("internal_tlds: valid_tlds must be set too")
+	}
+
+	for _, err := range []error{
+		checkBlockMode(cfg.BlockMode),
+		checkAnyMode(cfg.AnyQueryMode),
+		checkECSMode(cfg.ECSMode),
+		checkRebindMode(cfg.RebindProtection),
+	} {
+		if err != nil {
+			addErr("%v", err)
+		}
+	}
+	if cfg.ECSPrefixV4 < 1 || cfg.ECSPrefixV4 > 32 {
+		addErr("ecs_prefix_v4: must be between 1 and 32")
+	}
+	if cfg.ECSPrefixV6 < 1 || cfg.ECSPrefixV6 > 128 {
+		addErr("ecs_prefix_v6: must be between 1 and 128")
+	}
+	if cfg.EDNSUDPSize < dns.MinMsgSize || cfg.EDNSUDPSize > dns.MaxMsgSize {
+		addErr("edns_udp_size: must be between %d and %d", dns.MinMsgSize, dns.MaxMsgSize)
+	}
+	if cfg.BlacklistDB != "" && cfg.DumpEffectiveList != "" {
+		addErr("dump_effective_list: cannot be used with blacklist_db")
+	}
+	if err := checkMode(cfg.Mode); err != nil {
+		addErr("%v", err)
+	}
+	if cfg.Mode == modeAllowlist && cfg.DumpEffectiveList != "" {
+		addErr("dump_effective_list: cannot be used with mode allowlist")
+	}
+	if cfg.Mode == modeAllowlist && len(cfg.Whitelists) == 0 && len(cfg.RPZZones) == 0 {
+		addErr("whitelists: must be set with mode allowlist")
+	}
+	if err := checkStartupMode(cfg.StartupMode); err != nil {
+		addErr("%v", err)
+	}
+	if err := checkSOAOwner(cfg.BlockSOA.Owner); err != nil {
+		addErr("%v", err)
+	}
+	if cfg.CircuitBreakerErrorPercent < 0 || cfg.CircuitBreakerErrorPercent > 100 {
+		addErr("circuit_breaker_error_percent: must be between 0 and 100")
+	}
+	if len(cfg.ExternalPolicy) != 0 {
+		if _, err := exec.LookPath(cfg.ExternalPolicy[0]); err != nil {
+			addErr("external_policy: %v", err)
+		}
+		if cfg.ExternalPolicyTimeoutMs < 0 {
+			addErr("external_policy_timeout_ms: must not be negative")
+		}
+		if cfg.ExternalPolicyCacheSecs < 0 {
+			addErr("external_policy_cache_secs: must not be negative")
+		}
+		if cfg.ExternalPolicyMaxProcs < 0 {
+			addErr("external_policy_max_procs: must not be negative")
+		}
+	}
+	if cfg.MaxUDPResponse < dns.MinMsgSize || cfg.MaxUDPResponse > dns.MaxMsgSize {
+		addErr("max_udp_response: must be between %d and %d", dns.MinMsgSize, dns.MaxMsgSize)
+	}
+	if _, err := parseSinkhole(cfg.SinkholeIPv4, false); err != nil {
+		addErr("sinkhole_ipv4: %v", err)
+	}
+	if _, err := parseSinkhole(cfg.SinkholeIPv6, true); err != nil {
+		addErr("sinkhole_ipv6: %v", err)
+	}
+	if _, err := parseQtypes(cfg.BlockQtypes); err != nil {
+		addErr("block_qtypes: %v", err)
+	}
+	if _, err := parseCIDRs(cfg.AllowedClients); err != nil {
+		addErr("allowed_clients: %v", err)
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		addErr("tls_cert and tls_key must be set together")
+	} else if len(cfg.TLSListen) != 0 && cfg.TLSCert == "" {
+		addErr("tls_listen: tls_cert and tls_key are required")
+	}
+
+	if cfg.BlockCNAME != "" {
+		if _, ok := dns.IsDomainName(cfg.BlockCNAME); !ok {
+			addErr("block_cname: %s is not a domain name", cfg.BlockCNAME)
+		}
+	}
+
+	if cfg.MaxTTL != 0 && cfg.MinTTL > cfg.MaxTTL {
+		addErr("min_ttl: %d is greater than max_ttl %d", cfg.MinTTL, cfg.MaxTTL)
+	}
+
+	categories := make(map[string]bool, len(cfg.Categories))
+	for i, c := range cfg.Categories {
+		prefix := fmt.Sprintf("categories[%d]", i)
+		switch {
+		case c.Name == "":
+			addErr("%s.name: must be set", prefix)
+		case categories[c.Name]:
+			addErr("%s.name: duplicate category %s", prefix, c.Name)
+		}
+		categories[c.Name] = true
+		checkLists(prefix+".blacklists", c.Blacklists)
+	}
+
+	for i, view := range cfg.Views {
+		prefix := fmt.Sprintf("views[%d]", i)
+		checkLists(prefix+".blacklists", view.Blacklists)
+		checkLists(prefix+".whitelists", view.Whitelists)
+		for j, entry := range view.Downstreams {
+			if err := checkDownstream(entry); err != nil {
+				addErr("%s.downstreams[%d]: %v", prefix, j, err)
+			}
+		}
+		if view.BlockMode != "" {
+			if err := checkBlockMode(view.BlockMode); err != nil {
+				addErr("%s.block_mode: %v", prefix, err)
+			}
+		}
+		if _, err := viewPolicy(view, cfg); err != nil {
+			addErr("%s.%v", prefix, err)
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+func checkListenAddr(addr string) error {
+	addr, _ = splitInterface(addr)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return fmt.Errorf("%s is not an IP address", host)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("malformed port: %s", port)
+	}
+	return nil
+}
+
+func checkDownstream(entry string) error {
+	addr, _, err := splitWeight(entry)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case strings.HasPrefix(addr, "https://"):
+		u, err := url.Parse(addr)
+		if err != nil {
+			return err
+		}
+		if u.Host == "" {
+			return fmt.Errorf("missing host: %s", addr)
+		}
+		return nil
+	case strings.HasPrefix(addr, "tls://"):
+		hostPort := strings.TrimPrefix(addr, "tls://")
+		if indx := strings.Index(hostPort, "#"); indx != -1 {
+			hostPort = hostPort[:indx]
+		}
+		host, _, err := splitDownstreamAddr(hostPort, "853")
+		if err != nil {
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+		return checkHost(host)
+	case strings.Contains(addr, "://"):
+		return fmt.Errorf("unsupported scheme: %s", addr)
+	default:
+		host, _, err := splitDownstreamAddr(addr, "53")
+		if err != nil {
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+		return checkHost(host)
+	}
+}
+
+func checkHost(host string) error {
+	if strings.Contains(host, "%") {
+		ip, zone := splitZone(host)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("%s: zones are only allowed for IPv6 addresses", host)
+		}
+		if zone == "" {
+			return fmt.Errorf("%s: empty zone", host)
+		}
+		return nil
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if _, ok := dns.IsDomainName(host); !ok || host == "" {
+		return fmt.Errorf("%s is not an IP address or a host name", host)
+	}
+	return nil
+}
+
+func checkListPath(path string) error {
+	if isURL(path) {
+		if _, err := url.Parse(path); err != nil {
+			return err
+		}
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
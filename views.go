@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// view is the policy applied to queries from a set of client networks
+// instead of the global one.
+type view struct {
+	name    string
+	clients []*net.IPNet
+	cfg     ViewConfig
+
+	// Guarded by Server.listsLock. nil if the view uses global lists, this
+	// way views that only change downstreams do not keep a copy of them.
+	lists *domainLists
+
+	// nil if the view uses global downstreams.
+	downstreams []*downstream
+	schedule    []int
+
+	// nil if the view uses the global block policy.
+	block *blockPolicy
+}
+
+func (v *view) ownLists() bool {
+	return len(v.cfg.Blacklists) != 0 || len(v.cfg.Whitelists) != 0
+}
+
+// listsConfig returns cfg with list paths replaced by the ones of the view.
+func (v *view) listsConfig(cfg Config) Config {
+	cfg.Blacklists = v.cfg.Blacklists
+	cfg.Whitelists = v.cfg.Whitelists
+	// RPZ zones and categories apply to the global lists only.
+	cfg.RPZZones = nil
+	cfg.Categories = nil
+	cfg.DumpEffectiveList = ""
+	cfg.BlacklistDB = ""
+	return cfg
+}
+
+// viewPolicy returns the block policy of the view. block_mode defaults to
+// the global one, as does block_cname unless the view sets sinkhole
+// addresses, which would never be used otherwise.
+func viewPolicy(vcfg ViewConfig, cfg Config) (*blockPolicy, error) {
+	p := &blockPolicy{mode: vcfg.BlockMode}
+	if p.mode == "" {
+		p.mode = cfg.BlockMode
+	}
+	var err error
+	p.sinkholeV4, err = parseSinkhole(vcfg.SinkholeIPv4, false)
+	if err != nil {
+		return nil, fmt.Errorf("sinkhole_ipv4: %w", err)
+	}
+	p.sinkholeV6, err = parseSinkhole(vcfg.SinkholeIPv6, true)
+	if err != nil {
+		return nil, fmt.Errorf("sinkhole_ipv6: %w", err)
+	}
+	switch {
+	case vcfg.BlockCNAME != "":
+		if _, ok := dns.IsDomainName(vcfg.BlockCNAME); !ok {
+			return nil, fmt.Errorf("block_cname: %s is not a domain name", vcfg.BlockCNAME)
+		}
+		p.cname = normalize(vcfg.BlockCNAME)
+	case p.sinkholeV4 == nil && p.sinkholeV6 == nil:
+		p.cname = normalize(cfg.BlockCNAME)
+	}
+	return p, nil
+}
+
+func newViews(cfg Config, timeouts downstreamTimeouts) ([]*view, error) {
+	views := make([]*view, 0, len(cfg.Views))
+	for i, vcfg := range cfg.Views {
+		name := vcfg.Name
+		if name == "" {
+			name = fmt.Sprint(i)
+		}
+		if len(vcfg.Clients) == 0 {
+			return nil, fmt.Errorf("view %s: clients must be set", name)
+		}
+		clients, err := parseCIDRs(vcfg.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %w", name, err)
+		}
+
+		v := &view{
+			name:    name,
+			clients: clients,
+			cfg:     vcfg,
+		}
+		for _, entry := range vcfg.Downstreams {
+			addr, weight, err := splitWeight(entry)
+			if err != nil {
+				return nil, fmt.Errorf("view %s: %w", name, err)
+			}
+			d, err := parseDownstream(addr, cfg.DownstreamNet, timeouts)
+			if err != nil {
+				return nil, fmt.Errorf("view %s: %w", name, err)
+			}
+			d.weight = weight
+			v.downstreams = append(v.downstreams, d)
+		}
+		if v.downstreams != nil {
+			v.schedule = weightedSchedule(v.downstreams)
+		}
+		if vcfg.BlockMode != "" || vcfg.SinkholeIPv4 != "" || vcfg.SinkholeIPv6 != "" || vcfg.BlockCNAME != "" {
+			v.block, err = viewPolicy(vcfg, cfg)
+			if err != nil {
+				return nil, fmt.Errorf("view %s: %w", name, err)
+			}
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+// loadViewLists reads lists of views that have their own ones. The result
+// has an entry for each view, nil for ones using global lists.
+func loadViewLists(views []*view, cfg Config) ([]*domainLists, error) {
+	lists := make([]*domainLists, len(views))
+	for i, v := range views {
+		if !v.ownLists() {
+			continue
+		}
+		// Views have no categories.
+		l, err := loadLists(v.listsConfig(cfg), nil)
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %w", v.name, err)
+		}
+		lists[i] = l
+	}
+	return lists, nil
+}
+
+// viewFor returns the first view containing the client address or nil if
+// the global policy should be used.
+func (s *Server) viewFor(addr net.Addr) *view {
+	if len(s.views) == 0 {
+		return nil
+	}
+	ip := remoteIP(addr)
+	if ip == nil {
+		return nil
+	}
+	for _, v := range s.views {
+		for _, n := range v.clients {
+			if n.Contains(ip) {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// listsFor returns lists used for queries in view v. listsLock must be held.
+func (s *Server) listsFor(v *view) *domainLists {
+	if v != nil && v.lists != nil {
+		return v.lists
+	}
+	return s.lists
+}
+
+// downstreamsFor returns downstreams used for queries in view v and their
+// round-robin schedule.
+func (s *Server) downstreamsFor(v *view) ([]*downstream, []int) {
+	if v != nil && v.downstreams != nil {
+		return v.downstreams, v.schedule
+	}
+	return s.downstreams, s.schedule
+}
+
+// allDownstreams returns global downstreams followed by ones of all views.
+func (s *Server) allDownstreams() []*downstream {
+	all := make([]*downstream, 0, len(s.downstreams))
+	all = append(all, s.downstreams...)
+	for _, v := range s.views {
+		all = append(all, v.downstreams...)
+	}
+	return all
+}
+
+// cacheKey returns the key for responses to queries from view v. Views with
+// their own downstreams get separate cache entries.
+func (s *Server) cacheKey(v *view, name string, qtype, qclass uint16) cacheKey {
+	key := cacheKey{name: name, qtype: qtype, qclass: qclass}
+	if v != nil && v.downstreams != nil {
+		key.view = v.name
+	}
+	return key
+}